@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// invalidNameChars are replaced with _ to turn a meter name into a metric
+// name.
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// discoveredMeters holds the meters exported by -actuator.enable-all-discovered
+// besides those of the meter groups.
+type discoveredMeters struct {
+	group *meterGroup
+	// seen holds every meter looked at, exported or not, so each is only
+	// fetched once to learn its shape.
+	seen map[string]bool
+	// names holds the metric names in use, to skip meters that would
+	// collide once sanitized.
+	names map[string]bool
+}
+
+func newDiscoveredMeters() *discoveredMeters {
+	return &discoveredMeters{
+		group: &meterGroup{name: "discovered", enabled: featureOn},
+		seen:  make(map[string]bool),
+		names: make(map[string]bool),
+	}
+}
+
+// discoverMeters adds a metric for every meter of names not exported yet.
+func (e *Exporter) discoverMeters(names []string) {
+	d := e.allMeters
+	for _, g := range e.meterGroups {
+		for _, m := range g.metrics {
+			d.seen[m.meter] = true
+		}
+	}
+	// Exported as process_start_time_seconds already.
+	d.seen["process.start.time"] = true
+	for _, name := range names {
+		if d.seen[name] || !e.included(name) {
+			continue
+		}
+		d.seen[name] = true
+		var resp meterResponse
+		if err := e.fetchMeter(name, nil, &resp); err != nil {
+			slog.ErrorContext(e.logContext(), "Can't scrape meter", "target", redactURL(e.URL), "meter", name, "err", redactError(err))
+			e.partialFailure(false)
+			// Try again with the next scrape.
+			delete(d.seen, name)
+			continue
+		}
+		if m := e.newDiscoveredMeter(resp); m != nil {
+			d.group.metrics = append(d.group.metrics, m)
+		}
+	}
+}
+
+// newDiscoveredMeter maps the statistics of a meter to metrics the way
+// Micrometer's Prometheus registry would: timers and distribution
+// summaries (COUNT with TOTAL_TIME or TOTAL) get _count, _sum and _max,
+// counters (COUNT alone) _total, gauges (VALUE) the plain name. The base
+// unit is appended if it is seconds or bytes. Every available tag becomes
+// a label.
+func (e *Exporter) newDiscoveredMeter(resp meterResponse) *meterMetric {
+	base := e.renames.rename(resp.Name, invalidNameChars.ReplaceAllString(resp.Name, "_"))
+	name := base
+	if (resp.BaseUnit == "seconds" || resp.BaseUnit == "bytes") && !strings.HasSuffix(name, "_"+resp.BaseUnit) {
+		name += "_" + resp.BaseUnit
+	}
+	stats := make(map[string]bool, len(resp.Measurements))
+	for _, s := range resp.Measurements {
+		stats[s.Statistic] = true
+	}
+	var tags []string
+	for _, t := range resp.AvailableTags {
+		tags = append(tags, t.Tag)
+	}
+	sort.Strings(tags)
+	labels := tagLabels(tags)
+
+	m := &meterMetric{
+		meter:    resp.Name,
+		tags:     tags,
+		stats:    make(map[string]*prometheus.GaugeVec),
+		counters: make(map[string]*prometheus.CounterVec),
+		last:     make(map[string]float64),
+	}
+	// A COUNT without a total is a counter.
+	counter := stats["COUNT"] && !stats["TOTAL_TIME"] && !stats["TOTAL"]
+	metricNames := make(map[string]string, len(stats))
+	for s := range stats {
+		switch s {
+		case "COUNT":
+			metricNames[s] = name + "_count"
+			if counter {
+				metricNames[s] = base + "_total"
+			}
+		case "TOTAL_TIME", "TOTAL":
+			metricNames[s] = name + "_sum"
+		case "MAX":
+			metricNames[s] = name + "_max"
+		case "VALUE":
+			metricNames[s] = name
+		case "ACTIVE_TASKS":
+			metricNames[s] = base + "_active_tasks"
+		default:
+			metricNames[s] = name + "_" + strings.ToLower(s)
+		}
+	}
+	d := e.allMeters
+	for _, n := range metricNames {
+		if d.names[n] {
+			logOnce(e.logContext(), slog.LevelWarn, "taken "+e.URL+" "+resp.Name, "Not exporting meter: metric name is taken", "target", redactURL(e.URL), "meter", resp.Name, "metric", n)
+			return nil
+		}
+	}
+	help := resp.Description
+	if help == "" {
+		help = "Micrometer meter " + resp.Name
+	}
+	for s, n := range metricNames {
+		d.names[n] = true
+		if s == "COUNT" && counter {
+			m.counters[s] = prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace:   namespace,
+				Name:        n,
+				Help:        help,
+				ConstLabels: e.labels,
+			}, labels)
+			continue
+		}
+		m.stats[s] = newMetrics(n, help, e.labels, labels)
+	}
+	return m
+}
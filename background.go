@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// backgroundScrape scrapes an exporter on its own timer and keeps the
+// metrics of the last scrape for Collect to serve.
+type backgroundScrape struct {
+	stop   chan struct{}
+	latest atomic.Value // *backgroundResult
+}
+
+type backgroundResult struct {
+	metrics []prometheus.Metric
+	taken   time.Time
+}
+
+// jitterOffset spreads the first scrape of the targets over jitter. The
+// offset only depends on the URL, so a target keeps its slot across
+// restarts and reloads.
+func jitterOffset(url string, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(url))
+	return time.Duration(rand.New(rand.NewSource(int64(h.Sum64()))).Int63n(int64(jitter)))
+}
+
+// startBackground starts scraping every e.scrapeInterval, the first time
+// after the target's jitter offset. It does nothing if the exporter scrapes
+// on demand or is already running.
+func (e *Exporter) startBackground() {
+	if e.scrapeInterval <= 0 {
+		return
+	}
+	e.bgMu.Lock()
+	defer e.bgMu.Unlock()
+	if e.bg != nil {
+		return
+	}
+	e.bg = &backgroundScrape{stop: make(chan struct{})}
+	go e.runBackground(e.bg)
+}
+
+// stopBackground stops the background scrapes started by startBackground.
+func (e *Exporter) stopBackground() {
+	e.bgMu.Lock()
+	defer e.bgMu.Unlock()
+	if e.bg != nil {
+		close(e.bg.stop)
+		e.bg = nil
+	}
+}
+
+// collectBackground sends the metrics of the last background scrape, with
+// their age. Metrics older than the maximum snapshot age are replaced by
+// up=0. Nothing is sent before the first background scrape is done.
+func (e *Exporter) collectBackground(ch chan<- prometheus.Metric, bg *backgroundScrape) {
+	res, _ := bg.latest.Load().(*backgroundResult)
+	if res == nil {
+		return
+	}
+	age := time.Since(res.taken)
+	e.snapshotAge.Set(age.Seconds())
+	ch <- e.snapshotAge
+	if e.snapshotMaxAge > 0 && age > e.snapshotMaxAge {
+		ch <- prometheus.MustNewConstMetric(e.up.Desc(), prometheus.GaugeValue, 0)
+		ch <- frozen(e.lastAttempt)
+		ch <- frozen(e.lastSuccess)
+		return
+	}
+	for _, m := range res.metrics {
+		ch <- m
+	}
+}
+
+func (e *Exporter) background() *backgroundScrape {
+	e.bgMu.Lock()
+	defer e.bgMu.Unlock()
+	return e.bg
+}
+
+func (e *Exporter) runBackground(bg *backgroundScrape) {
+	timer := time.NewTimer(jitterOffset(e.URL, e.scrapeJitter))
+	defer timer.Stop()
+	select {
+	case <-bg.stop:
+		return
+	case <-timer.C:
+	}
+	ticker := time.NewTicker(e.scrapeInterval)
+	defer ticker.Stop()
+	for {
+		bg.latest.Store(&backgroundResult{metrics: gatherMetrics(func(ch chan<- prometheus.Metric) {
+			e.collect(context.Background(), ch)
+		}), taken: time.Now()})
+
+		select {
+		case <-bg.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// With a scrape interval, Collect serves the results of the background
+// scrapes instead of scraping the target itself.
+func TestBackgroundScrape(t *testing.T) {
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mem": 1}`))
+	}))
+	defer ts.Close()
+
+	e := NewExporter(ts.URL+"/metrics", Options{
+		Timeout:        time.Second,
+		ScrapeInterval: time.Hour,
+		SnapshotMaxAge: 200 * time.Millisecond,
+	})
+	e.startBackground()
+	defer e.stopBackground()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if v, _ := findMetric(gather(t, e), "spring_actuator_up", nil); v == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no background scrape served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := atomic.LoadInt64(&requests)
+	for i := 0; i < 3; i++ {
+		gather(t, e)
+	}
+	if n := atomic.LoadInt64(&requests); n != before {
+		t.Errorf("Collect made %d requests to the target", n-before)
+	}
+
+	// The hour-long interval leaves the first scrape to go stale.
+	time.Sleep(250 * time.Millisecond)
+	mfs := gather(t, e)
+	if v, ok := findMetric(mfs, "spring_actuator_up", nil); !ok || v != 0 {
+		t.Errorf("stale background scrape: up = %v (found %v), want 0", v, ok)
+	}
+	if _, ok := findMetric(mfs, "spring_actuator_mem", nil); ok {
+		t.Error("metrics of a stale background scrape served")
+	}
+}
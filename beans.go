@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// beanScopes are the scopes always exported, 0 if no bean has them.
+var beanScopes = []string{"singleton", "prototype", "request", "session"}
+
+type beansMetrics struct {
+	enabled bool
+	total   prometheus.Gauge
+	byScope *prometheus.GaugeVec
+	counted bool
+}
+
+func newBeansMetrics(opts Options) *beansMetrics {
+	return &beansMetrics{
+		enabled: opts.Beans,
+		total: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "beans_total",
+			Help:        "Number of Spring beans of every application context",
+			ConstLabels: opts.ConstLabels,
+		}),
+		byScope: newMetrics("beans_by_scope", "Number of Spring beans by scope", opts.ConstLabels, []string{"scope"}),
+	}
+}
+
+// bean is the part of a bean of the beans endpoint we look at, in both the
+// Spring Boot 1.x and 2.x formats.
+type bean struct {
+	Scope string `json:"scope"`
+}
+
+// beanScopeCounts counts the beans of a beans endpoint document by scope.
+// Spring Boot 2.x nests the beans by name under each context of
+// "contexts"; Spring Boot 1.x lists the contexts, each with a list of
+// beans.
+func beanScopeCounts(body json.RawMessage) (map[string]int, error) {
+	counts := make(map[string]int)
+	count := func(b bean) {
+		counts[strings.ToLower(b.Scope)]++
+	}
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		var contexts []struct {
+			Beans []bean `json:"beans"`
+		}
+		if err := json.Unmarshal(body, &contexts); err != nil {
+			return nil, err
+		}
+		for _, c := range contexts {
+			for _, b := range c.Beans {
+				count(b)
+			}
+		}
+		return counts, nil
+	}
+	var doc struct {
+		Contexts map[string]struct {
+			Beans map[string]bean `json:"beans"`
+		} `json:"contexts"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Contexts == nil {
+		return nil, fmt.Errorf("no contexts in beans endpoint response")
+	}
+	for _, c := range doc.Contexts {
+		for _, b := range c.Beans {
+			count(b)
+		}
+	}
+	return counts, nil
+}
+
+// scrapeBeans counts the beans of the beans endpoint.
+func (e *Exporter) scrapeBeans() error {
+	var body json.RawMessage
+	if err := e.fetchJSON(e.endpointURL("beans"), &body); err != nil {
+		return err
+	}
+	counts, err := beanScopeCounts(body)
+	if err != nil {
+		return err
+	}
+	b := e.beans
+	for _, s := range beanScopes {
+		b.byScope.WithLabelValues(s).Set(0)
+	}
+	total := 0
+	for s, n := range counts {
+		b.byScope.WithLabelValues(s).Set(float64(n))
+		total += n
+	}
+	b.total.Set(float64(total))
+	b.counted = true
+	return nil
+}
+
+func (b *beansMetrics) reset() {
+	b.byScope.Reset()
+	b.counted = false
+}
+
+func (b *beansMetrics) collect(ch chan<- prometheus.Metric) {
+	if b.counted {
+		ch <- b.total
+	}
+	b.byScope.Collect(ch)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newCertExpiryMetric(constLabels prometheus.Labels) *prometheus.GaugeVec {
+	return newMetrics("target_cert_expiry_timestamp_seconds", "Earliest expiry of the certificates presented by the target in the last scrape since unix epoch in seconds", constLabels, []string{"subject_cn"})
+}
+
+// certExpiry returns the earliest NotAfter of the verified chain of state,
+// or of the presented certificates if they weren't verified, and the common
+// name of the target's certificate.
+func certExpiry(state *tls.ConnectionState) (time.Time, string, bool) {
+	certs := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		certs = state.VerifiedChains[0]
+	}
+	if len(certs) == 0 {
+		return time.Time{}, "", false
+	}
+	earliest := certs[0].NotAfter
+	for _, c := range certs[1:] {
+		if c.NotAfter.Before(earliest) {
+			earliest = c.NotAfter
+		}
+	}
+	return earliest, state.PeerCertificates[0].Subject.CommonName, true
+}
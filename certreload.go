@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves the certificate in certFile/keyFile and reloads it
+// when either file's modification time changes or on SIGHUP. Only new
+// handshakes see the new certificate; established connections are left
+// alone.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	c, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	k, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return c.ModTime(), k.ModTime(), nil
+}
+
+func (r *certReloader) reload() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the files changed
+// but can't be loaded, for instance because the key has not been rewritten
+// yet, the previous certificate keeps being served.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certMod, keyMod, err := r.modTimes()
+	r.mu.Lock()
+	changed := err == nil && (!certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod))
+	r.mu.Unlock()
+	if changed {
+		if err := r.reload(); err != nil {
+			slog.Error("Can't reload TLS certificate", "file", r.certFile, "err", err)
+		} else {
+			slog.Info("Reloaded TLS certificate", "file", r.certFile)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// reloadOnSIGHUP reloads the certificate whenever the process receives
+// SIGHUP, until ctx is cancelled.
+func (r *certReloader) reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.reload(); err != nil {
+				slog.Error("Can't reload TLS certificate", "file", r.certFile, "err", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "file", r.certFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Rewriting the certificate files under a live server makes new
+// connections get the new certificate, while open ones keep working.
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "exporters")
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	oldCert, oldKey := ca.issue(t, "exporter", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, oldCert)
+	writeFile(t, keyFile, oldKey)
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := newTLSConfig(certs, "", "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: tlsConfig,
+	}
+	addr := serveTest(t, srv)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// served returns the certificate the server presents on a new
+	// connection.
+	served := func() []byte {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: conn.ConnectionState().PeerCertificates[0].Raw})
+	}
+	if string(served()) != string(oldCert) {
+		t.Fatal("server doesn't present the certificate it was started with")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	newCert, newKey := ca.issue(t, "exporter", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, newCert)
+	writeFile(t, keyFile, newKey)
+	// Make sure the modification times change on filesystems with a
+	// coarse resolution.
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(served()) != string(newCert) {
+		t.Error("new connection doesn't get the rotated certificate")
+	}
+	// The connection opened before the rotation is reused.
+	resp, err = client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("request on a connection opened before the rotation: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+)
+
+// valueChanges logs, at debug level, the values that changed by more than
+// threshold percent since the last successful scrape. A nil valueChanges
+// logs nothing.
+type valueChanges struct {
+	threshold float64
+	previous  map[string]float64
+	current   map[string]float64
+}
+
+func newValueChanges(threshold float64) *valueChanges {
+	if threshold <= 0 {
+		return nil
+	}
+	return &valueChanges{threshold: threshold, current: make(map[string]float64)}
+}
+
+// observe records the value of key in the scrape in progress.
+func (c *valueChanges) observe(key string, v float64) {
+	if c != nil {
+		c.current[key] = v
+	}
+}
+
+// done ends the scrape in progress. The values of a successful scrape are
+// compared to, then replace, those of the previous one; those of a failed
+// scrape are dropped.
+func (c *valueChanges) done(ctx context.Context, url string, err error) {
+	if c == nil {
+		return
+	}
+	current := c.current
+	c.current = make(map[string]float64)
+	if err != nil {
+		return
+	}
+	keys := make([]string, 0, len(current))
+	for k := range current {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		prev, ok := c.previous[k]
+		if !ok {
+			continue
+		}
+		v := current[k]
+		change := (v - prev) / math.Abs(prev) * 100
+		if prev == v {
+			change = 0
+		}
+		if math.Abs(change) > c.threshold {
+			slog.DebugContext(ctx, "Metric changed", "target", redactURL(url), "metric", k, "from", prev, "to", v, "change", fmt.Sprintf("%+.0f%%", change))
+		}
+	}
+	c.previous = current
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of circuit_breaker_state.
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+var errCircuitOpen = errors.New("not scraped: too many consecutive failures, circuit breaker open")
+
+// circuitBreaker stops scraping a target that failed threshold times in a
+// row for backoff. Then one scrape is tried again: if it succeeds the
+// target is scraped as usual, else it is left alone for another backoff.
+// It is only used under the exporter's collectMu. A nil *circuitBreaker
+// never opens.
+type circuitBreaker struct {
+	threshold int
+	backoff   time.Duration
+	// now tells the time, so tests can move it.
+	now func() time.Time
+
+	failures  int
+	openUntil time.Time
+	state     prometheus.Gauge
+}
+
+func newCircuitBreaker(threshold int, backoff time.Duration, constLabels prometheus.Labels) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		backoff:   backoff,
+		now:       time.Now,
+		state: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "circuit_breaker_state",
+			Help:        "State of the circuit breaker of the target: 0 closed, 1 open, 2 half-open",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// allow reports whether the target may be scraped now.
+func (b *circuitBreaker) allow() bool {
+	if b == nil || b.failures < b.threshold {
+		return true
+	}
+	if b.now().Before(b.openUntil) {
+		return false
+	}
+	b.state.Set(circuitHalfOpen)
+	return true
+}
+
+// record updates the breaker with the outcome of a scrape of url.
+func (b *circuitBreaker) record(ctx context.Context, url string, err error) {
+	if b == nil {
+		return
+	}
+	if err == nil {
+		if b.failures >= b.threshold {
+			slog.InfoContext(ctx, "Target answered again, resuming scrapes", "target", redactURL(url))
+		}
+		b.failures = 0
+		b.state.Set(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			slog.WarnContext(ctx, "Target failed too many times in a row, scraping it less often until it answers", "target", redactURL(url), "failures", b.failures, "interval", b.backoff)
+		}
+		b.openUntil = b.now().Add(b.backoff)
+		b.state.Set(circuitOpen)
+	}
+}
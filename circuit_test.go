@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClock is a time that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	b := newCircuitBreaker(2, time.Minute, nil)
+	b.now = clock.now
+	ctx := context.Background()
+	failed := errors.New("connection refused")
+
+	expect := func(step string, allowed bool, state float64) {
+		t.Helper()
+		if got := b.allow(); got != allowed {
+			t.Fatalf("%s: allow() = %v, want %v", step, got, allowed)
+		}
+		if got := testutil.ToFloat64(b.state); got != state {
+			t.Fatalf("%s: state = %v, want %v", step, got, state)
+		}
+	}
+
+	expect("new", true, circuitClosed)
+	b.record(ctx, "http://app/metrics", failed)
+	expect("one failure", true, circuitClosed)
+	b.record(ctx, "http://app/metrics", failed)
+	expect("threshold reached", false, circuitOpen)
+	clock.advance(59 * time.Second)
+	expect("within backoff", false, circuitOpen)
+
+	clock.advance(time.Second)
+	expect("backoff over", true, circuitHalfOpen)
+	// A failed probe opens the circuit for another backoff right away.
+	b.record(ctx, "http://app/metrics", failed)
+	expect("half-open probe failed", false, circuitOpen)
+	clock.advance(30 * time.Second)
+	expect("within second backoff", false, circuitOpen)
+
+	clock.advance(30 * time.Second)
+	expect("second backoff over", true, circuitHalfOpen)
+	b.record(ctx, "http://app/metrics", nil)
+	expect("half-open probe succeeded", true, circuitClosed)
+	// The failures start over once closed.
+	b.record(ctx, "http://app/metrics", failed)
+	expect("one failure after closing", true, circuitClosed)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute, nil)
+	if b != nil {
+		t.Fatal("threshold 0 built a breaker")
+	}
+	b.record(context.Background(), "http://app/metrics", errors.New("x"))
+	if !b.allow() {
+		t.Error("nil breaker refused a scrape")
+	}
+}
+
+func TestExporterSkipsOpenCircuit(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	e := NewExporter(ts.URL+"/metrics", Options{Timeout: time.Second, CircuitBreakerFailures: 1, CircuitBreakerBackoff: time.Minute})
+	e.breaker.now = clock.now
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	sent := atomic.LoadInt32(&requests)
+	if sent == 0 {
+		t.Fatal("first scrape sent no request")
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&requests); got != sent {
+		t.Errorf("scrape with an open circuit sent %d requests", got-sent)
+	}
+	if got := testutil.ToFloat64(e.scrapeErrors.WithLabelValues("circuit_open")); got != 1 {
+		t.Errorf("circuit_open errors = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(e.up); got != 0 {
+		t.Errorf("up = %v with an open circuit", got)
+	}
+
+	clock.advance(time.Minute)
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&requests); got == sent {
+		t.Error("no request once the backoff was over")
+	}
+}
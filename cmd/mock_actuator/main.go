@@ -0,0 +1,158 @@
+// mock_actuator simulates the actuator of a Spring Boot 2.x application
+// with any number of meters, so that the exporter can be load tested
+// without a Java application.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// mockTag is the tag every meter carries when -tags-per-meter is set.
+const mockTag = "instance"
+
+// mockActuator serves the actuator index, health and metrics endpoints.
+// Values are drawn from a PRNG seeded by the meter name and tag value, so
+// they are the same in every response.
+type mockActuator struct {
+	meters      []string
+	index       map[string]int
+	tagValues   []string
+	seed        int64
+	latency     time.Duration
+	failureRate float64
+}
+
+func newMockActuator(numMeters, tagsPerMeter int, seed int64, latency time.Duration, failureRate float64) *mockActuator {
+	a := &mockActuator{index: make(map[string]int), seed: seed, latency: latency, failureRate: failureRate}
+	for i := 0; i < numMeters; i++ {
+		name := fmt.Sprintf("mock.meter.%d", i)
+		a.meters = append(a.meters, name)
+		a.index[name] = i
+	}
+	for i := 0; i < tagsPerMeter; i++ {
+		a.tagValues = append(a.tagValues, fmt.Sprintf("value-%d", i))
+	}
+	return a
+}
+
+// value returns the value of a statistic of a meter for one tag value.
+func (a *mockActuator) value(meter, tagValue, statistic string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(meter + "\xff" + tagValue + "\xff" + statistic))
+	r := rand.New(rand.NewSource(a.seed ^ int64(h.Sum64())))
+	return float64(r.Intn(1000000)) / 100
+}
+
+// statistics returns the statistics of a meter: every third one is a
+// timer, the others are gauges.
+func statistics(index int) []string {
+	if index%3 == 0 {
+		return []string{"COUNT", "TOTAL_TIME", "MAX"}
+	}
+	return []string{"VALUE"}
+}
+
+// meter answers a request for a single meter, summing the values of the
+// tag values that match the tag query like Micrometer does.
+func (a *mockActuator) meter(w http.ResponseWriter, r *http.Request, index int) {
+	name := a.meters[index]
+	values := a.tagValues
+	for _, q := range r.URL.Query()["tag"] {
+		kv := strings.SplitN(q, ":", 2)
+		if len(kv) != 2 || kv[0] != mockTag || !a.hasTagValue(kv[1]) {
+			http.NotFound(w, r)
+			return
+		}
+		values = []string{kv[1]}
+	}
+	if len(values) == 0 {
+		values = []string{""}
+	}
+	var measurements []map[string]interface{}
+	for _, s := range statistics(index) {
+		v := 0.0
+		for _, tv := range values {
+			v += a.value(name, tv, s)
+		}
+		measurements = append(measurements, map[string]interface{}{"statistic": s, "value": v})
+	}
+	tags := []map[string]interface{}{}
+	if len(a.tagValues) > 0 {
+		tags = append(tags, map[string]interface{}{"tag": mockTag, "values": a.tagValues})
+	}
+	writeJSON(w, map[string]interface{}{
+		"name":          name,
+		"measurements":  measurements,
+		"availableTags": tags,
+	})
+}
+
+func (a *mockActuator) hasTagValue(v string) bool {
+	for _, tv := range a.tagValues {
+		if tv == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *mockActuator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(a.latency)
+	if rand.Float64() < a.failureRate {
+		http.Error(w, "simulated failure", http.StatusInternalServerError)
+		return
+	}
+	base := "http://" + r.Host + "/actuator"
+	switch path := strings.TrimSuffix(r.URL.Path, "/"); {
+	case path == "/actuator":
+		links := map[string]interface{}{"self": map[string]interface{}{"href": base}}
+		for _, name := range []string{"health", "metrics"} {
+			links[name] = map[string]interface{}{"href": base + "/" + name}
+		}
+		writeJSON(w, map[string]interface{}{"_links": links})
+	case path == "/actuator/health":
+		writeJSON(w, map[string]string{"status": "UP"})
+	case path == "/actuator/metrics":
+		writeJSON(w, map[string]interface{}{"names": a.meters})
+	case strings.HasPrefix(path, "/actuator/metrics/"):
+		index, ok := a.index[strings.TrimPrefix(path, "/actuator/metrics/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		a.meter(w, r, index)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func main() {
+	var (
+		listenAddress = flag.String("listen-address", ":8080", "Address to serve the simulated actuator on.")
+		numMeters     = flag.Int("num-meters", 100, "Number of meters to serve.")
+		tagsPerMeter  = flag.Int("tags-per-meter", 0, "Number of values of the instance tag of every meter; 0 for untagged meters.")
+		latency       = flag.Duration("latency", 0, "Time to wait before answering each request.")
+		failureRate   = flag.Float64("failure-rate", 0, "Fraction of requests, between 0 and 1, answered with a 500.")
+		seed          = flag.Int64("seed", 1, "Seed of the meter values; the same seed gives the same values.")
+	)
+	flag.Parse()
+	if *numMeters < 0 || *tagsPerMeter < 0 || *failureRate < 0 || *failureRate > 1 {
+		log.Fatal("-num-meters and -tags-per-meter can't be negative, and -failure-rate must be between 0 and 1")
+	}
+	a := newMockActuator(*numMeters, *tagsPerMeter, *seed, *latency, *failureRate)
+	log.Printf("Serving %d meters with %d tag values each on %s/actuator/metrics", *numMeters, *tagsPerMeter, *listenAddress)
+	log.Fatal(http.ListenAndServe(*listenAddress, a))
+}
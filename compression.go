@@ -0,0 +1,97 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// expositionCompressor gzips expositions for clients that accept it, unless
+// disabled, and counts the bytes produced before and after compression.
+type expositionCompressor struct {
+	disabled bool
+	bytes    *prometheus.CounterVec
+}
+
+func newExpositionCompressor(disabled bool) *expositionCompressor {
+	return &expositionCompressor{
+		disabled: disabled,
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exposition_bytes_total",
+			Help:      "Bytes of metrics exposition written, before (uncompressed) and after (sent) compression",
+		}, []string{"stage"}),
+	}
+}
+
+func (c *expositionCompressor) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent := &countingWriter{w: w, counter: c.bytes.WithLabelValues("sent")}
+		cw := &compressingWriter{ResponseWriter: w, body: sent, counter: c.bytes.WithLabelValues("uncompressed")}
+		if !c.disabled && acceptsGzip(r) {
+			gz := gzip.NewWriter(sent)
+			cw.body, cw.gzip = gz, true
+			defer func() {
+				// The gzip trailer must follow the Content-Encoding header.
+				cw.WriteHeader(http.StatusOK)
+				gz.Close()
+			}()
+		}
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+type countingWriter struct {
+	w       io.Writer
+	counter prometheus.Counter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// compressingWriter counts what the wrapped handler writes and passes it on
+// to body, which gzips it when gzip is set.
+type compressingWriter struct {
+	http.ResponseWriter
+	body        io.Writer
+	counter     prometheus.Counter
+	gzip        bool
+	wroteHeader bool
+}
+
+func (w *compressingWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.gzip {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.body.Write(p)
+	w.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// targetsCheckInterval is how often the targets file is checked for changes.
+const targetsCheckInterval = 10 * time.Second
+
+// secret is a configuration string that is never shown back.
+type secret string
+
+func (s secret) MarshalYAML() (interface{}, error) {
+	if s == "" {
+		return "", nil
+	}
+	return "<secret>", nil
+}
+
+// targetsConfig is the content of the -actuator.targets-file.
+type targetsConfig struct {
+	Targets []*targetConfig `yaml:"targets"`
+	// Modules are the scrape settings /probe can select with ?module=.
+	Modules map[string]*scrapeConfig `yaml:"modules,omitempty"`
+	// MetricOverrides convert the unit of Spring Boot 1.x metrics of every
+	// target and probe.
+	MetricOverrides []*metricOverride `yaml:"metric_overrides,omitempty"`
+}
+
+// metricOverride scales the values of the Spring Boot 1.x metric keys
+// matching MetricName and adds Unit to the metric name.
+type metricOverride struct {
+	MetricName      string   `yaml:"metric_name"`
+	Unit            string   `yaml:"unit,omitempty"`
+	ValueMultiplier *float64 `yaml:"value_multiplier,omitempty"`
+}
+
+// metricUnits are the unit suffixes a metric override may add.
+var metricUnits = map[string]bool{"bytes": true, "seconds": true, "ratio": true, "total": true}
+
+// defaultModule is used by /probe when no module is asked for.
+const defaultModule = "default"
+
+type targetConfig struct {
+	Name         string            `yaml:"name"`
+	URL          string            `yaml:"url"`
+	Labels       map[string]string `yaml:"labels,omitempty"`
+	scrapeConfig `yaml:",inline"`
+}
+
+// scrapeConfig holds how an actuator is scraped, for a configured target
+// or a probe module.
+type scrapeConfig struct {
+	ActuatorVersion  string          `yaml:"actuator_version,omitempty"`
+	Auth             authConfig      `yaml:"auth,omitempty"`
+	TLS              tlsClientConfig `yaml:"tls,omitempty"`
+	MetricInclude    []string        `yaml:"metric_include,omitempty"`
+	MeterGroups      map[string]bool `yaml:"meter_groups,omitempty"`
+	IntegrationGraph *bool           `yaml:"integration_graph,omitempty"`
+	Endpoints        map[string]bool `yaml:"endpoints,omitempty"`
+}
+
+type authConfig struct {
+	Username    string `yaml:"username,omitempty"`
+	Password    secret `yaml:"password,omitempty"`
+	BearerToken secret `yaml:"bearer_token,omitempty"`
+}
+
+type tlsClientConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// configErrors collects every problem found in a configuration so they can
+// all be reported at once.
+type configErrors []error
+
+func (errs configErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func loadTargetsConfig(filename string) (*targetsConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargetsConfig(b)
+}
+
+func parseTargetsConfig(b []byte) (*targetsConfig, error) {
+	var cfg targetsConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (cfg *targetsConfig) validate() error {
+	var errs configErrors
+	names := make(map[string]bool, len(cfg.Targets))
+	for i, t := range cfg.Targets {
+		if t == nil {
+			errs = append(errs, fmt.Errorf("target #%d: empty entry", i+1))
+			continue
+		}
+		for _, err := range t.validate() {
+			errs = append(errs, fmt.Errorf("target %q (#%d): %v", t.Name, i+1, err))
+		}
+		if names[t.Name] {
+			errs = append(errs, fmt.Errorf("target %q (#%d): duplicate name", t.Name, i+1))
+		}
+		names[t.Name] = true
+	}
+	for name, m := range cfg.Modules {
+		if m == nil {
+			errs = append(errs, fmt.Errorf("module %q: empty entry", name))
+			continue
+		}
+		for _, err := range m.validate() {
+			errs = append(errs, fmt.Errorf("module %q: %v", name, err))
+		}
+	}
+	for i, o := range cfg.MetricOverrides {
+		if o == nil {
+			errs = append(errs, fmt.Errorf("metric override #%d: empty entry", i+1))
+			continue
+		}
+		for _, err := range o.validate() {
+			errs = append(errs, fmt.Errorf("metric override %q (#%d): %v", o.MetricName, i+1, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (t *targetConfig) validate() []error {
+	var errs []error
+	if t.Name == "" {
+		errs = append(errs, fmt.Errorf("name is required"))
+	}
+	if t.URL == "" {
+		errs = append(errs, fmt.Errorf("url is required"))
+	} else if u, err := url.Parse(t.URL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid url: %s", redactError(err)))
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("url %q must be an absolute http or https URL", redactURL(t.URL)))
+	}
+	for name := range t.Labels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			errs = append(errs, fmt.Errorf("invalid label name %q", name))
+		} else if name == "target" {
+			errs = append(errs, fmt.Errorf("label name %q is reserved", name))
+		}
+	}
+	return append(errs, t.scrapeConfig.validate()...)
+}
+
+func (o *metricOverride) validate() []error {
+	var errs []error
+	if o.MetricName == "" {
+		errs = append(errs, fmt.Errorf("metric_name is required"))
+	} else if _, err := path.Match(o.MetricName, ""); err != nil {
+		errs = append(errs, fmt.Errorf("invalid metric_name pattern: %v", err))
+	}
+	if o.Unit != "" && !metricUnits[o.Unit] {
+		errs = append(errs, fmt.Errorf("unit must be bytes, seconds, ratio or total, not %q", o.Unit))
+	}
+	if o.ValueMultiplier != nil && *o.ValueMultiplier == 0 {
+		errs = append(errs, fmt.Errorf("value_multiplier can't be 0"))
+	}
+	return errs
+}
+
+// findMetricOverride returns the first of overrides matching the metric
+// key, or nil.
+func findMetricOverride(overrides []*metricOverride, key string) *metricOverride {
+	for _, o := range overrides {
+		if ok, _ := path.Match(o.MetricName, key); ok {
+			return o
+		}
+	}
+	return nil
+}
+
+// name adds the unit suffix to name, unless it is already there.
+func (o *metricOverride) name(name string) string {
+	if o.Unit == "" || strings.HasSuffix(name, "_"+o.Unit) {
+		return name
+	}
+	return name + "_" + o.Unit
+}
+
+// multiplier returns the factor values are scaled by, 1 if not set.
+func (o *metricOverride) multiplier() float64 {
+	if o.ValueMultiplier == nil {
+		return 1
+	}
+	return *o.ValueMultiplier
+}
+
+func (c *scrapeConfig) validate() []error {
+	var errs []error
+	switch c.ActuatorVersion {
+	case "", "1", "2":
+	default:
+		errs = append(errs, fmt.Errorf("actuator_version must be 1 or 2, not %q", c.ActuatorVersion))
+	}
+	if c.Auth.BearerToken != "" && (c.Auth.Username != "" || c.Auth.Password != "") {
+		errs = append(errs, fmt.Errorf("auth can't have both a bearer_token and basic credentials"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("tls cert_file and key_file must be set together"))
+	}
+	for _, p := range c.MetricInclude {
+		if _, err := path.Match(p, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid metric_include pattern %q: %v", p, err))
+		}
+	}
+	for name := range c.MeterGroups {
+		if !knownMeterGroup(name) {
+			errs = append(errs, fmt.Errorf("unknown meter group %q", name))
+		}
+	}
+	for name := range c.Endpoints {
+		if !knownEndpoint(name) {
+			errs = append(errs, fmt.Errorf("unknown endpoint %q, must be one of %s", name, strings.Join(optionalEndpoints, ", ")))
+		}
+	}
+	return errs
+}
+
+func (c tlsClientConfig) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// renegotiationModes are the values of -actuator.tls-renegotiation.
+var renegotiationModes = map[string]tls.RenegotiationSupport{
+	"none":   tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// withRenegotiation returns cfg, or a new config if it is nil, set to
+// accept renegotiation r from the server.
+func withRenegotiation(cfg *tls.Config, r tls.RenegotiationSupport) *tls.Config {
+	if r == tls.RenegotiateNever {
+		return cfg
+	}
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg.Renegotiation = r
+	return cfg
+}
+
+// authTransport adds the target's credentials to every request, except
+// redirects to another host, where they could be collected.
+type authTransport struct {
+	next http.RoundTripper
+	auth authConfig
+}
+
+// originHost returns the host of the request that started the redirects
+// leading to req.
+func originHost(req *http.Request) string {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req.URL.Host
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != originHost(req) {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if t.auth.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+string(t.auth.BearerToken))
+	} else {
+		req.SetBasicAuth(t.auth.Username, string(t.auth.Password))
+	}
+	return t.next.RoundTrip(req)
+}
+
+func (t *authTransport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
+
+// options returns the exporter options for the target, based on the shared
+// defaults.
+func (t *targetConfig) options(defaults Options) (Options, error) {
+	opts, err := t.scrapeConfig.options(defaults)
+	if err != nil {
+		return opts, fmt.Errorf("target %q: %v", t.Name, err)
+	}
+	opts.ConstLabels = prometheus.Labels{"target": t.Name}
+	for k, v := range defaults.ConstLabels {
+		opts.ConstLabels[k] = v
+	}
+	for k, v := range t.Labels {
+		opts.ConstLabels[k] = v
+	}
+	return opts, nil
+}
+
+// options overrides defaults with the settings given in c.
+func (c *scrapeConfig) options(defaults Options) (Options, error) {
+	opts := defaults
+	if c.TLS != (tlsClientConfig{}) || c.Auth != (authConfig{}) {
+		var tlsConfig *tls.Config
+		if c.TLS != (tlsClientConfig{}) {
+			var err error
+			if tlsConfig, err = c.TLS.tlsConfig(); err != nil {
+				return opts, err
+			}
+		}
+		opts.Client, opts.ownsClient = newHTTPClient(defaults, tlsConfig), true
+		if c.Auth != (authConfig{}) {
+			knownSecrets.addBasicAuth(c.Auth.Username, string(c.Auth.Password))
+			knownSecrets.add(string(c.Auth.BearerToken))
+			opts.Client.Transport = &authTransport{next: opts.Client.Transport, auth: c.Auth}
+		}
+	}
+	if c.ActuatorVersion != "" {
+		opts.ActuatorVersion = c.ActuatorVersion
+	}
+	if len(c.MetricInclude) > 0 {
+		opts.MetricInclude = c.MetricInclude
+	}
+	if len(c.MeterGroups) > 0 {
+		opts.MeterGroups = make(map[string]featureFlag, len(defaults.MeterGroups))
+		for name, f := range defaults.MeterGroups {
+			opts.MeterGroups[name] = f
+		}
+		for name, on := range c.MeterGroups {
+			opts.MeterGroups[name] = featureOff
+			if on {
+				opts.MeterGroups[name] = featureOn
+			}
+		}
+	}
+	if c.IntegrationGraph != nil {
+		opts.IntegrationGraph = featureOff
+		if *c.IntegrationGraph {
+			opts.IntegrationGraph = featureOn
+		}
+	}
+	if len(c.Endpoints) > 0 {
+		opts.Endpoints = make(map[string]featureFlag, len(defaults.Endpoints))
+		for name, f := range defaults.Endpoints {
+			opts.Endpoints[name] = f
+		}
+		for name, on := range c.Endpoints {
+			opts.Endpoints[name] = featureOff
+			if on {
+				opts.Endpoints[name] = featureOn
+			}
+		}
+	}
+	return opts, nil
+}
+
+// labelNames returns extra plus every label name the targets carry, so
+// that all targets export the same label set.
+func (cfg *targetsConfig) labelNames(extra []string) []string {
+	names := mergeLabelNames(extra, "target")
+	for _, t := range cfg.Targets {
+		for n := range t.Labels {
+			names = mergeLabelNames(names, n)
+		}
+	}
+	return names
+}
+
+// moduleNames returns the sorted names of the probe modules.
+func (cfg *targetsConfig) moduleNames() []string {
+	names := make([]string, 0, len(cfg.Modules))
+	for name := range cfg.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// targetsReloader reloads the targets file when it changes, on SIGHUP and
+// on POST /-/reload, and hands the new configuration to apply. A file that
+// doesn't load leaves the running targets untouched.
+type targetsReloader struct {
+	path  string
+	apply func(*targetsConfig) error
+
+	mu      sync.Mutex
+	modTime time.Time
+
+	success     prometheus.Gauge
+	successTime prometheus.Gauge
+}
+
+func newTargetsReloader(path string, apply func(*targetsConfig) error) *targetsReloader {
+	r := &targetsReloader{
+		path:  path,
+		apply: apply,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last reload of the targets file succeeded",
+		}),
+		successTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Time of the last successful reload of the targets file",
+		}),
+	}
+	if fi, err := os.Stat(path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+	return r
+}
+
+func (r *targetsReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The modification time is recorded even if the file is invalid, so a
+	// broken file is reported once rather than on every check.
+	if fi, err := os.Stat(r.path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+	cfg, err := loadTargetsConfig(r.path)
+	if err == nil {
+		err = r.apply(cfg)
+	}
+	if err != nil {
+		r.success.Set(0)
+		return err
+	}
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+	return nil
+}
+
+func (r *targetsReloader) changed() bool {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !fi.ModTime().Equal(r.modTime)
+}
+
+func (r *targetsReloader) reloadAndLog(reason string) {
+	if err := r.reload(); err != nil {
+		slog.Error("Can't reload targets file, keeping the previous targets", "file", r.path, "err", redactError(err))
+	} else {
+		slog.Info("Reloaded targets", "file", r.path, "reason", reason)
+	}
+}
+
+// watch reloads the file when its modification time changes or the
+// process receives SIGHUP, until ctx is cancelled.
+func (r *targetsReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(targetsCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reloadAndLog("SIGHUP")
+		case <-ticker.C:
+			if r.changed() {
+				r.reloadAndLog("file changed")
+			}
+		}
+	}
+}
+
+// ServeHTTP reloads the file on POST and reports the outcome.
+func (r *targetsReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		slog.Error("Can't reload targets file, keeping the previous targets", "file", r.path, "err", redactError(err))
+		http.Error(w, redactError(err), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Reloaded targets", "file", r.path, "reason", "/-/reload")
+}
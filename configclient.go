@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// configRefresh tracks when the Spring Cloud Config client last fetched its
+// configuration successfully. The meters only count requests, so a refresh
+// is noticed as requests growing faster than failures between two scrapes,
+// and timed at the scrape that saw it.
+type configRefresh struct {
+	last  prometheus.Gauge
+	known bool
+}
+
+func newConfigRefresh(constLabels prometheus.Labels) *configRefresh {
+	return &configRefresh{
+		last: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "config_last_refresh_timestamp_seconds",
+			Help:        "Time of the scrape that first saw the last successful Spring Cloud Config refresh since unix epoch in seconds",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// updateConfigRefresh moves the last refresh time to now if the config
+// client made successful requests since the previous scrape.
+func (e *Exporter) updateConfigRefresh() {
+	requests := e.findMeter("spring.cloud.config.client.requests")
+	failures := e.findMeter("spring.cloud.config.client.failures")
+	if requests == nil || failures == nil {
+		return
+	}
+	if requests.growth > failures.growth {
+		e.configRefresh.last.Set(float64(time.Now().Unix()))
+		e.configRefresh.known = true
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// consulConfig is how targets are looked up in the Consul catalog.
+type consulConfig struct {
+	server     string
+	token      string
+	datacenter string
+	tags       []string
+	portMeta   string
+	scheme     string
+	path       *template.Template
+	// onlyPassing skips instances failing a health check.
+	onlyPassing bool
+}
+
+// consulServiceEntry is an element of GET /v1/health/service/:service.
+type consulServiceEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+// consulPathData is what the path template can refer to.
+type consulPathData struct {
+	Service string
+	Meta    map[string]string
+}
+
+func (c *consulConfig) get(ctx context.Context, client *http.Client, p string, query url.Values, v interface{}) error {
+	if c.datacenter != "" {
+		query.Set("dc", c.datacenter)
+	}
+	u := strings.TrimSuffix(c.server, "/") + p + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: StatusCode: %d", p, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func hasTags(tags, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// consulDiscovery lists the instances of the services carrying all of the
+// configured tags, labeled with the service name and the node.
+func consulDiscovery(client *http.Client, c *consulConfig) discoverFunc {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		var services map[string][]string
+		if err := c.get(ctx, client, "/v1/catalog/services", url.Values{}, &services); err != nil {
+			return nil, err
+		}
+		var (
+			targets []discoveredTarget
+			failed  []string
+		)
+		for name, tags := range services {
+			if !hasTags(tags, c.tags) {
+				continue
+			}
+			query := url.Values{}
+			for _, t := range c.tags {
+				query.Add("tag", t)
+			}
+			if c.onlyPassing {
+				query.Set("passing", "true")
+			}
+			var entries []consulServiceEntry
+			if err := c.get(ctx, client, "/v1/health/service/"+url.PathEscape(name), query, &entries); err != nil {
+				failed = append(failed, err.Error())
+				continue
+			}
+			for _, e := range entries {
+				addr := e.Service.Address
+				if addr == "" {
+					addr = e.Node.Address
+				}
+				port := strconv.Itoa(e.Service.Port)
+				if p := e.Service.Meta[c.portMeta]; p != "" {
+					port = p
+				}
+				var path bytes.Buffer
+				if err := c.path.Execute(&path, consulPathData{Service: e.Service.Service, Meta: e.Service.Meta}); err != nil {
+					failed = append(failed, fmt.Sprintf("path of %s: %v", e.Service.ID, err))
+					continue
+				}
+				targets = append(targets, discoveredTarget{
+					URL: c.scheme + "://" + net.JoinHostPort(addr, port) + path.String(),
+					Labels: map[string]string{
+						"service": e.Service.Service,
+						"node":    e.Node.Node,
+					},
+				})
+			}
+		}
+		if len(failed) > 0 {
+			return targets, fmt.Errorf("%s", strings.Join(failed, "; "))
+		}
+		return targets, nil
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// daemonEnv marks the re-executed child so it doesn't detach again.
+const daemonEnv = "SPRING_ACTUATOR_EXPORTER_DAEMON"
+
+// pidFile is the PID file written by writePIDFile, removed by
+// removePIDFile.
+var pidFile string
+
+// writePIDFile records the current PID in path, refusing to replace the PID
+// file of a process that is still running. The file is created exclusively,
+// so two exporters started at once can't both take it.
+func writePIDFile(path string) error {
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return err
+			}
+			pidFile = path
+			return nil
+		}
+		if !os.IsExist(err) || attempt == 2 {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// A PID file naming this process is left from an earlier run that
+		// had the same PID, as happens in containers.
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("%s belongs to running process %d", path, pid)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// removePIDFile removes the PID file written by writePIDFile, if any.
+func removePIDFile() {
+	if pidFile != "" {
+		os.Remove(pidFile)
+		pidFile = ""
+	}
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// daemonize starts a detached copy of the exporter with the same arguments
+// and reports whether the caller is the parent, which should exit.
+func daemonize() (bool, error) {
+	if os.Getenv(daemonEnv) != "" {
+		return false, nil
+	}
+	return true, startDetached(append(os.Environ(), daemonEnv+"=1"))
+}
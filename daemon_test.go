@@ -0,0 +1,79 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func readPID(t *testing.T, path string) int {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+func TestWritePIDFile(t *testing.T) {
+	defer removePIDFile()
+	path := filepath.Join(t.TempDir(), "exporter.pid")
+
+	if err := writePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if pid := readPID(t, path); pid != os.Getpid() {
+		t.Errorf("PID file holds %d, want %d", pid, os.Getpid())
+	}
+	removePIDFile()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file left after removePIDFile: %v", err)
+	}
+
+	// A running process keeps its PID file.
+	live := strconv.Itoa(os.Getppid()) + "\n"
+	if err := ioutil.WriteFile(path, []byte(live), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path); err == nil {
+		t.Error("PID file of a running process replaced")
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != live {
+		t.Errorf("PID file of a running process changed to %q", b)
+	}
+
+	// The PID file of a process that is gone is replaced.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("can't run a process to get a dead PID: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path); err != nil {
+		t.Fatalf("stale PID file not replaced: %v", err)
+	}
+	if pid := readPID(t, path); pid != os.Getpid() {
+		t.Errorf("PID file holds %d, want %d", pid, os.Getpid())
+	}
+
+	// So is one left by an earlier run with the same PID.
+	removePIDFile()
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path); err != nil {
+		t.Errorf("PID file with our own PID not replaced: %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "fmt"
+
+func startDetached(env []string) error {
+	return fmt.Errorf("running in the background is not supported on Windows")
+}
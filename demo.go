@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// demoApp simulates the actuator of a Spring Boot application for
+// -self-contained-demo: heap usage creeps up until a collection frees it,
+// and GC counts and times grow.
+type demoApp struct {
+	name  string
+	boot1 bool
+	start time.Time
+
+	mu           sync.Mutex
+	heapUsedKB   float64
+	gcCount      float64
+	gcTimeMillis float64
+	sessions     float64
+}
+
+const (
+	demoHeapKB      = 512 * 1024
+	demoHeapGrowKB  = 8 * 1024
+	demoHeapFloorKB = 96 * 1024
+)
+
+// step advances the simulation by one update.
+func (a *demoApp) step() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.heapUsedKB += demoHeapGrowKB
+	if a.heapUsedKB > 0.8*demoHeapKB {
+		a.heapUsedKB = demoHeapFloorKB
+		a.gcCount++
+		a.gcTimeMillis += 40
+	}
+	a.sessions = float64(10 + int(a.gcCount)%7)
+}
+
+func (a *demoApp) uptimeMillis() float64 {
+	return float64(time.Since(a.start) / time.Millisecond)
+}
+
+func writeDemoJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *demoApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.boot1 {
+		w.Header().Set("X-Application-Context", a.name+":8080")
+		switch r.URL.Path {
+		case "/metrics":
+			writeDemoJSON(w, map[string]float64{
+				"mem":                   demoHeapKB + 64*1024,
+				"mem.free":              demoHeapKB - a.heapUsedKB,
+				"heap.committed":        demoHeapKB,
+				"heap.used":             a.heapUsedKB,
+				"nonheap.committed":     80 * 1024,
+				"nonheap.used":          72 * 1024,
+				"threads":               42,
+				"classes":               9000,
+				"classes.loaded":        9000,
+				"classes.unloaded":      0,
+				"gc.ps_scavenge.count":  a.gcCount,
+				"gc.ps_scavenge.time":   a.gcTimeMillis,
+				"gc.ps_marksweep.count": a.gcCount / 10,
+				"gc.ps_marksweep.time":  a.gcTimeMillis / 10,
+				"systemload.average":    0.5,
+				"uptime":                a.uptimeMillis(),
+			})
+		case "/health":
+			writeDemoJSON(w, map[string]string{"status": "UP"})
+		case "/info":
+			writeDemoJSON(w, map[string]interface{}{"app": map[string]string{"name": a.name, "version": "1.0.0"}})
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+	base := "http://" + r.Host + "/actuator"
+	meter := func(v float64, unit string) map[string]interface{} {
+		return map[string]interface{}{
+			"baseUnit":      unit,
+			"measurements":  []map[string]interface{}{{"statistic": "VALUE", "value": v}},
+			"availableTags": []interface{}{},
+		}
+	}
+	meters := map[string]map[string]interface{}{
+		"process.start.time":             meter(float64(a.start.Unix()), "seconds"),
+		"process.uptime":                 meter(a.uptimeMillis()/1000, "seconds"),
+		"jvm.memory.used":                meter(a.heapUsedKB*1024, "bytes"),
+		"tomcat.sessions.active.current": meter(a.sessions, "sessions"),
+		"jvm.gc.pause": {
+			"baseUnit": "seconds",
+			"measurements": []map[string]interface{}{
+				{"statistic": "COUNT", "value": a.gcCount},
+				{"statistic": "TOTAL_TIME", "value": a.gcTimeMillis / 1000},
+				{"statistic": "MAX", "value": 0.04},
+			},
+			"availableTags": []interface{}{},
+		},
+	}
+	switch path := strings.TrimSuffix(r.URL.Path, "/"); {
+	case path == "/actuator":
+		links := map[string]interface{}{"self": map[string]interface{}{"href": base}}
+		for _, name := range []string{"health", "info", "metrics"} {
+			links[name] = map[string]interface{}{"href": base + "/" + name}
+		}
+		writeDemoJSON(w, map[string]interface{}{"_links": links})
+	case path == "/actuator/metrics":
+		names := make([]string, 0, len(meters))
+		for name := range meters {
+			names = append(names, name)
+		}
+		writeDemoJSON(w, map[string]interface{}{"names": names})
+	case strings.HasPrefix(path, "/actuator/metrics/"):
+		name := strings.TrimPrefix(path, "/actuator/metrics/")
+		m, ok := meters[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		m["name"] = name
+		writeDemoJSON(w, m)
+	case path == "/actuator/health":
+		writeDemoJSON(w, map[string]string{"status": "UP"})
+	case path == "/actuator/info":
+		writeDemoJSON(w, map[string]interface{}{
+			"app":   map[string]string{"name": a.name, "version": "2.3.1"},
+			"build": map[string]string{"version": "2.3.1"},
+			"git":   map[string]interface{}{"branch": "main", "commit": map[string]string{"id": "4f2c9e1"}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// startDemo serves a Spring Boot 1.x and a 2.x demo application, updated
+// every interval until ctx is done, and returns their metrics URLs.
+func startDemo(ctx context.Context, interval time.Duration) []string {
+	apps := []*demoApp{
+		{name: "demo-orders", start: time.Now(), heapUsedKB: demoHeapFloorKB},
+		{name: "demo-billing", boot1: true, start: time.Now(), heapUsedKB: demoHeapFloorKB},
+	}
+	var uris []string
+	for _, a := range apps {
+		srv := httptest.NewServer(a)
+		path := "/actuator/metrics"
+		if a.boot1 {
+			path = "/metrics"
+		}
+		uris = append(uris, srv.URL+path)
+		go func(a *demoApp) {
+			defer srv.Close()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					a.step()
+				}
+			}
+		}(a)
+	}
+	return uris
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// discoveredTarget is an actuator found by a discovery mechanism, with the
+// labels that identify it.
+type discoveredTarget struct {
+	URL    string
+	Labels prometheus.Labels
+}
+
+func (t discoveredTarget) key() string {
+	pairs := make([]string, 0, len(t.Labels))
+	for k, v := range t.Labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return t.URL + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// discoverFunc returns the targets currently known to a discovery
+// mechanism. It may return the targets it found along with an error when
+// only part of the lookup failed.
+type discoverFunc func(ctx context.Context) ([]discoveredTarget, error)
+
+type discoveredEntry struct {
+	target   discoveredTarget
+	exporter *Exporter
+	lastSeen time.Time
+}
+
+// discoveryManager keeps a target set in line with a discovery mechanism.
+// Targets that stop being discovered are scraped, and their series
+// exported, until they have been missing for the grace period. While
+// discovery fails nothing expires.
+type discoveryManager struct {
+	name          string
+	discover      discoverFunc
+	interval      time.Duration
+	grace         time.Duration
+	maxConcurrent int
+
+	// changed wakes run up before the next interval, for mechanisms that
+	// are told about changes.
+	changed chan struct{}
+
+	mu      sync.Mutex
+	opts    Options
+	entries map[string]*discoveredEntry
+	targets liveTargets
+	// lastRefresh is when discovery last succeeded.
+	lastRefresh time.Time
+}
+
+func newDiscoveryManager(name string, discover discoverFunc, opts Options, interval, grace time.Duration, maxConcurrent int) *discoveryManager {
+	return &discoveryManager{
+		name:          name,
+		discover:      discover,
+		interval:      interval,
+		grace:         grace,
+		maxConcurrent: maxConcurrent,
+		opts:          opts,
+		entries:       make(map[string]*discoveredEntry),
+		changed:       make(chan struct{}, 1),
+	}
+}
+
+// notify asks for a refresh as soon as possible.
+func (m *discoveryManager) notify() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (m *discoveryManager) newExporter(t discoveredTarget) *Exporter {
+	o := m.opts
+	o.ConstLabels = prometheus.Labels{"target": targetLabel(t.URL)}
+	for k, v := range m.opts.ConstLabels {
+		o.ConstLabels[k] = v
+	}
+	for k, v := range t.Labels {
+		o.ConstLabels[k] = v
+	}
+	knownSecrets.addURL(t.URL)
+	return NewExporter(t.URL, o)
+}
+
+// refresh runs discovery once and updates the targets.
+func (m *discoveryManager) refresh(ctx context.Context) {
+	found, err := m.discover(ctx)
+	if err != nil {
+		slog.Error("Discovery failed", "discovery", m.name, "err", redactError(err))
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range found {
+		k := t.key()
+		if e, ok := m.entries[k]; ok {
+			e.lastSeen = now
+			continue
+		}
+		slog.Info("Discovered target", "discovery", m.name, "target", redactURL(t.URL))
+		m.entries[k] = &discoveredEntry{target: t, exporter: m.newExporter(t), lastSeen: now}
+	}
+	if err == nil {
+		m.lastRefresh = now
+		for k, e := range m.entries {
+			if now.Sub(e.lastSeen) > m.grace {
+				slog.Info("Lost target", "discovery", m.name, "target", redactURL(e.target.URL))
+				delete(m.entries, k)
+			}
+		}
+	}
+	m.publish()
+}
+
+// setOptions makes opts the options of the targets. The exporters are only
+// rebuilt if the label names or the metric overrides changed, or if rebuild
+// is set, e.g. after the rename rules changed; otherwise they keep their
+// state.
+func (m *discoveryManager) setOptions(opts Options, rebuild bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !rebuild && reflect.DeepEqual(m.opts.LabelNames, opts.LabelNames) && reflect.DeepEqual(m.opts.MetricOverrides, opts.MetricOverrides) {
+		m.opts = opts
+		return
+	}
+	m.opts = opts
+	for _, e := range m.entries {
+		e.exporter = m.newExporter(e.target)
+	}
+	m.publish()
+}
+
+// publish stores the current entries as the target set. m.mu must be held.
+func (m *discoveryManager) publish() {
+	keys := make([]string, 0, len(m.entries))
+	for k := range m.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ts := &targetSet{maxConcurrent: m.maxConcurrent, labelNames: m.opts.LabelNames, source: m.name}
+	for _, k := range keys {
+		ts.exporters = append(ts.exporters, m.entries[k].exporter)
+	}
+	m.targets.Store(ts)
+}
+
+// LastRefresh returns when discovery last succeeded, or the zero time.
+func (m *discoveryManager) LastRefresh() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastRefresh
+}
+
+// run refreshes the targets every interval until ctx is cancelled.
+func (m *discoveryManager) run(ctx context.Context) {
+	m.refresh(ctx)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.refresh(ctx)
+		case <-m.changed:
+			m.refresh(ctx)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Discovered targets keep their exporters, and so their state, when the
+// options change in a way that doesn't affect them.
+func TestDiscoverySetOptions(t *testing.T) {
+	discover := func(ctx context.Context) ([]discoveredTarget, error) {
+		return []discoveredTarget{{URL: "http://app:8080/actuator/metrics", Labels: prometheus.Labels{"pod": "app-0"}}}, nil
+	}
+	opts := Options{Timeout: time.Second, LabelNames: []string{"target", "pod"}}
+	m := newDiscoveryManager("test", discover, opts, time.Minute, time.Minute, 1)
+	m.refresh(context.Background())
+	first := m.targets.Load().exporters[0]
+
+	m.setOptions(opts, false)
+	if e := m.targets.Load().exporters[0]; e != first {
+		t.Error("exporter rebuilt although the options are the same")
+	}
+	opts.LabelNames = []string{"target", "pod", "env"}
+	m.setOptions(opts, false)
+	second := m.targets.Load().exporters[0]
+	if second == first {
+		t.Error("exporter not rebuilt after the label names changed")
+	}
+	m.setOptions(opts, true)
+	if e := m.targets.Load().exporters[0]; e == second {
+		t.Error("exporter not rebuilt when asked to")
+	}
+}
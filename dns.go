@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// dnsSRVDiscovery resolves the SRV records names and turns every host:port
+// they point to into a target scraped at scheme://host:port/path, labeled
+// with instance="host:port".
+func dnsSRVDiscovery(names []string, scheme, path string) discoverFunc {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		var (
+			targets []discoveredTarget
+			failed  []string
+		)
+		for _, name := range names {
+			_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+			if err != nil {
+				failed = append(failed, err.Error())
+				continue
+			}
+			for _, srv := range srvs {
+				hostport := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+				targets = append(targets, discoveredTarget{
+					URL:    scheme + "://" + hostport + path,
+					Labels: map[string]string{"instance": hostport},
+				})
+			}
+		}
+		if len(failed) > 0 {
+			return targets, fmt.Errorf("%s", strings.Join(failed, "; "))
+		}
+		return targets, nil
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// refreshConnections closes the idle connections of shared and of the
+// clients of the targets of c every interval until ctx is done, so that
+// the next requests dial, and look the host names up, again. Go doesn't
+// cache DNS answers, but a connection kept alive stays with the address it
+// was dialed to, which in Kubernetes or ECS may have moved to another pod.
+func refreshConnections(ctx context.Context, interval time.Duration, shared *http.Client, c *targetsCollector) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			shared.CloseIdleConnections()
+			c.closeIdleConnections()
+		}
+	}
+}
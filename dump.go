@@ -0,0 +1,92 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// dumpHandler serves every metric gathered from g as CSV rows of
+// timestamp,metric_name,label_json,value for offline analysis. With
+// ?compress=true the file is gzipped.
+func dumpHandler(g prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mfs, err := g.Gather()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		now := time.Now().UTC()
+		filename := "spring_actuator_dump_" + now.Format("20060102T150405") + ".csv"
+
+		var out io.Writer = w
+		if compress, _ := strconv.ParseBool(r.URL.Query().Get("compress")); compress {
+			filename += ".gz"
+			w.Header().Set("Content-Type", "application/gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+		cw := csv.NewWriter(out)
+		cw.Write([]string{"timestamp", "metric_name", "label_json", "value"})
+		ts := now.Format(time.RFC3339)
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				labels := make(map[string]string, len(m.GetLabel()))
+				for _, lp := range m.GetLabel() {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				labelJSON, _ := json.Marshal(labels)
+				for _, s := range samples(mf, m) {
+					cw.Write([]string{ts, s.name, string(labelJSON), strconv.FormatFloat(s.value, 'g', -1, 64)})
+				}
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			slog.Error("Writing dump failed", "err", err)
+		}
+	}
+}
+
+type sample struct {
+	name  string
+	value float64
+}
+
+// samples flattens a metric into named samples. Summaries and histograms
+// are reduced to their _sum and _count samples.
+func samples(mf *dto.MetricFamily, m *dto.Metric) []sample {
+	name := mf.GetName()
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		return []sample{{name, m.GetCounter().GetValue()}}
+	case dto.MetricType_GAUGE:
+		return []sample{{name, m.GetGauge().GetValue()}}
+	case dto.MetricType_SUMMARY:
+		return []sample{
+			{name + "_sum", m.GetSummary().GetSampleSum()},
+			{name + "_count", float64(m.GetSummary().GetSampleCount())},
+		}
+	case dto.MetricType_HISTOGRAM:
+		return []sample{
+			{name + "_sum", m.GetHistogram().GetSampleSum()},
+			{name + "_count", float64(m.GetHistogram().GetSampleCount())},
+		}
+	default:
+		return []sample{{name, m.GetUntyped().GetValue()}}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// endpointConcurrency bounds how many endpoints of one target are fetched
+// at the same time.
+const endpointConcurrency = 3
+
+// endpointRetryInterval is how long a missing health or info endpoint is
+// left alone in auto mode.
+const endpointRetryInterval = time.Hour
+
+// optionalEndpoints are the endpoints that can be turned on and off, by
+// the names used in flags and in the targets file.
+var optionalEndpoints = []string{"health", "info"}
+
+func knownEndpoint(name string) bool {
+	for _, n := range optionalEndpoints {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointState tracks whether an optional endpoint should be fetched.
+type endpointState struct {
+	enabled   featureFlag
+	missingAt time.Time
+}
+
+// due reports whether the endpoint should be fetched in this scrape.
+func (s *endpointState) due() bool {
+	switch s.enabled {
+	case featureOn:
+		return true
+	case featureOff:
+		return false
+	}
+	return s.missingAt.IsZero() || time.Since(s.missingAt) >= endpointRetryInterval
+}
+
+// done records the outcome of a fetch. In auto mode a missing endpoint
+// isn't a failure.
+func (s *endpointState) done(err error) error {
+	if err == errNotFound && s.enabled == featureAuto {
+		s.missingAt = time.Now()
+		return nil
+	}
+	s.missingAt = time.Time{}
+	return err
+}
+
+// healthStatuses are the statuses Spring Boot defines; an application may
+// add its own.
+var healthStatuses = []string{"UP", "DOWN", "OUT_OF_SERVICE", "UNKNOWN"}
+
+type healthMetrics struct {
+	endpointState
+	status *prometheus.GaugeVec
+}
+
+func newHealthMetrics(opts Options) *healthMetrics {
+	return &healthMetrics{
+		endpointState: endpointState{enabled: opts.Endpoints["health"]},
+		status:        newMetrics("health_status", "Status reported by the health endpoint: 1 for the current status, 0 for the others", opts.ConstLabels, []string{"status"}),
+	}
+}
+
+type infoMetrics struct {
+	endpointState
+	info *prometheus.GaugeVec
+}
+
+func newInfoMetrics(opts Options) *infoMetrics {
+	return &infoMetrics{
+		endpointState: endpointState{enabled: opts.Endpoints["info"]},
+		info:          newMetrics("application_info", "Application name, version and git commit from the info endpoint", opts.ConstLabels, []string{"app_name", "app_version", "git_branch", "git_commit"}),
+	}
+}
+
+// scrapeEndpoints fetches the metrics endpoint and the other enabled
+// endpoints of the target concurrently. Only a failure of the metrics
+// endpoint fails the scrape; the others are reported by endpoint_up.
+func (e *Exporter) scrapeEndpoints() error {
+	type endpoint struct {
+		name   string
+		scrape func() error
+	}
+	e.refreshLinks()
+	endpoints := []endpoint{{"metrics", e.scrapeMetrics}}
+	if e.health.due() {
+		endpoints = append(endpoints, endpoint{"health", func() error { return e.health.done(e.scrapeHealth()) }})
+	}
+	if e.info.due() {
+		endpoints = append(endpoints, endpoint{"info", func() error { return e.info.done(e.scrapeInfo()) }})
+	}
+	if e.beans.enabled {
+		endpoints = append(endpoints, endpoint{"beans", e.scrapeBeans})
+	}
+	errs := make([]error, len(endpoints))
+	sem := make(chan struct{}, endpointConcurrency)
+	var wg sync.WaitGroup
+	for i, ep := range endpoints {
+		wg.Add(1)
+		go func(i int, ep endpoint) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = ep.scrape()
+		}(i, ep)
+	}
+	// The integration graph has its own enable and retry logic.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sem <- struct{}{}
+		defer func() { <-sem }()
+		e.scrapeIntegrationGraph()
+	}()
+	wg.Wait()
+
+	for i, ep := range endpoints {
+		up := 1.0
+		if errs[i] != nil {
+			up = 0
+			if i > 0 {
+				e.errorLogs.log(e.logContext(), "endpoint "+ep.name, "Can't scrape endpoint", "target", redactURL(e.URL), "endpoint", ep.name, "err", redactError(errs[i]))
+			}
+		} else {
+			e.errorLogs.ok("endpoint " + ep.name)
+		}
+		e.endpointUp.WithLabelValues(ep.name).Set(up)
+		missing := 0.0
+		if isNotFound(errs[i]) {
+			missing = 1
+		}
+		e.notExposed.WithLabelValues(ep.name).Set(missing)
+	}
+	return errs[0]
+}
+
+// isNotFound reports whether err is a 404 answer, which for an actuator
+// endpoint usually means it isn't in management.endpoints.web.exposure.include.
+func isNotFound(err error) bool {
+	var status statusError
+	return errors.Is(err, errNotFound) || errors.As(err, &status) && status == http.StatusNotFound
+}
+
+// scrapeHealth exports the status of the health endpoint. A DOWN
+// application answers 503, which is read like a 200 and not retried.
+func (e *Exporter) scrapeHealth() error {
+	resp, err := e.getAttempts(e.endpointURL("health"), 1)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusServiceUnavailable:
+	case http.StatusNotFound:
+		return errNotFound
+	default:
+		return statusError(resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &health); err != nil {
+		return err
+	}
+	for _, s := range healthStatuses {
+		e.health.status.WithLabelValues(s).Set(0)
+	}
+	if health.Status != "" {
+		e.health.status.WithLabelValues(health.Status).Set(1)
+	}
+	return nil
+}
+
+// scrapeInfo exports the application details of the info endpoint, as
+// published by the build-info and git-commit-id plugins or set in app.*
+// properties.
+func (e *Exporter) scrapeInfo() error {
+	var info map[string]interface{}
+	if err := e.fetchJSON(e.endpointURL("info"), &info); err != nil {
+		return err
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := lookupInfo(info, k); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	e.info.info.WithLabelValues(
+		first("app.name", "build.name", "build.artifact"),
+		first("app.version", "build.version"),
+		first("git.branch"),
+		first("git.commit.id.abbrev", "git.commit.id"),
+	).Set(1)
+	return nil
+}
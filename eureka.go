@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// eurekaApps is the part of Eureka's GET /apps response we use.
+type eurekaApps struct {
+	Applications struct {
+		Application []struct {
+			Name     string           `json:"name"`
+			Instance []eurekaInstance `json:"instance"`
+		} `json:"application"`
+	} `json:"applications"`
+}
+
+type eurekaInstance struct {
+	InstanceID     string `json:"instanceId"`
+	HostName       string `json:"hostName"`
+	App            string `json:"app"`
+	Status         string `json:"status"`
+	HealthCheckURL string `json:"healthCheckUrl"`
+	Port           struct {
+		Port int `json:"$"`
+	} `json:"port"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// metricsURL works out where the instance serves its actuator metrics: a
+// metrics.url or management.url metadata entry, the sibling of its health
+// check URL, or host and management port (or port) with the management
+// context path (or defaultPath).
+func (i eurekaInstance) metricsURL(defaultPath string) string {
+	if u := i.Metadata["metrics.url"]; u != "" {
+		return u
+	}
+	if u := i.Metadata["management.url"]; u != "" {
+		return strings.TrimSuffix(u, "/") + "/metrics"
+	}
+	if strings.HasSuffix(i.HealthCheckURL, "/health") {
+		return strings.TrimSuffix(i.HealthCheckURL, "health") + "metrics"
+	}
+	port := strconv.Itoa(i.Port.Port)
+	if p := i.Metadata["management.port"]; p != "" {
+		port = p
+	}
+	p := defaultPath
+	if ctx := i.Metadata["management.context-path"]; ctx != "" {
+		p = path.Join("/", ctx, "metrics")
+	}
+	return "http://" + net.JoinHostPort(i.HostName, port) + p
+}
+
+// eurekaDiscovery lists the UP instances registered in the Eureka server
+// at baseURL whose app name matches one of the glob patterns apps (all
+// apps if empty), labeled with app and instance_id.
+func eurekaDiscovery(client *http.Client, baseURL string, apps []string, username, password, defaultPath string) discoverFunc {
+	return func(ctx context.Context) ([]discoveredTarget, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/apps", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("StatusCode: %d", resp.StatusCode)
+		}
+		var registry eurekaApps
+		if err := json.NewDecoder(resp.Body).Decode(&registry); err != nil {
+			return nil, err
+		}
+
+		var targets []discoveredTarget
+		for _, app := range registry.Applications.Application {
+			if !matchesAny(apps, strings.ToLower(app.Name)) {
+				continue
+			}
+			for _, i := range app.Instance {
+				if i.Status != "UP" {
+					continue
+				}
+				targets = append(targets, discoveredTarget{
+					URL: i.metricsURL(defaultPath),
+					Labels: map[string]string{
+						"app":         strings.ToLower(app.Name),
+						"instance_id": i.InstanceID,
+					},
+				})
+			}
+		}
+		return targets, nil
+	}
+}
+
+// matchesAny reports whether name matches one of the path.Match patterns,
+// or whether there are no patterns at all.
+func matchesAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
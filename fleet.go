@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// targetEntry describes a target on the /targets page.
+type targetEntry struct {
+	Source string            `json:"source"`
+	Labels map[string]string `json:"labels"`
+	scrapeStatus
+}
+
+// exporters returns the exporters of every current target.
+func (c *targetsCollector) exporters() []*Exporter {
+	var exporters []*Exporter
+	for _, l := range c.sets {
+		if ts := l.Load(); ts != nil {
+			exporters = append(exporters, ts.exporters...)
+		}
+	}
+	return exporters
+}
+
+// entries lists every current target, in the order they are scraped.
+func (c *targetsCollector) entries() []targetEntry {
+	var entries []targetEntry
+	for _, l := range c.sets {
+		ts := l.Load()
+		if ts == nil {
+			continue
+		}
+		for _, e := range ts.exporters {
+			entries = append(entries, newTargetEntry(ts.source, e))
+		}
+	}
+	return entries
+}
+
+func newTargetEntry(source string, e *Exporter) targetEntry {
+	labels := make(map[string]string, len(e.labels))
+	for k, v := range e.labels {
+		// Labels only there to match other targets are left out.
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	return targetEntry{Source: source, Labels: labels, scrapeStatus: e.Status()}
+}
+
+// redactURL hides the password of a URL with credentials, and any other
+// known secret in it.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return redact(rawurl)
+	}
+	return redact(u.Redacted())
+}
+
+// fleetCollector exports rollups of the targets from what is already known
+// about them, without scraping anything.
+type fleetCollector struct {
+	targets     *targetsCollector
+	discoveries []*discoveryManager
+
+	targetsDesc *prometheus.Desc
+	upDesc      *prometheus.Desc
+	refreshDesc *prometheus.Desc
+}
+
+func newFleetCollector(targets *targetsCollector, discoveries []*discoveryManager) *fleetCollector {
+	return &fleetCollector{
+		targets:     targets,
+		discoveries: discoveries,
+		targetsDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "targets"), "Number of targets, by where they come from", []string{"source"}, nil),
+		upDesc:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "targets_up"), "Number of targets whose last scrape succeeded, by where they come from", []string{"source"}, nil),
+		refreshDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "discovery_last_refresh_timestamp_seconds"), "Time discovery last succeeded since unix epoch in seconds, by mechanism", []string{"mechanism"}, nil),
+	}
+}
+
+func (c *fleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.targetsDesc
+	ch <- c.upDesc
+	ch <- c.refreshDesc
+}
+
+func (c *fleetCollector) Collect(ch chan<- prometheus.Metric) {
+	total := make(map[string]int)
+	up := make(map[string]int)
+	for _, t := range c.targets.entries() {
+		total[t.Source]++
+		if t.Up {
+			up[t.Source]++
+		}
+	}
+	for source, n := range total {
+		ch <- prometheus.MustNewConstMetric(c.targetsDesc, prometheus.GaugeValue, float64(n), source)
+		ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, float64(up[source]), source)
+	}
+	for _, d := range c.discoveries {
+		if t := d.LastRefresh(); !t.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.refreshDesc, prometheus.GaugeValue, float64(t.UnixNano())/1e9, d.name)
+		}
+	}
+}
+
+var targetsPage = template.Must(template.New("targets").Parse(`<html>
+<head><title>Spring Actuator Exporter targets</title></head>
+<body>
+<h1>Targets</h1>
+<table border="1">
+<tr><th>Source</th><th>URL</th><th>Labels</th><th>Up</th><th>Last scrape</th><th>Duration</th><th>Error</th><th>Scrape ID</th></tr>
+{{range .}}<tr><td>{{.Source}}</td><td>{{.URL}}</td><td>{{range $k, $v := .Labels}}{{$k}}="{{$v}}" {{end}}</td><td>{{if .Time.IsZero}}-{{else}}{{.Up}}{{end}}</td><td>{{if not .Time.IsZero}}{{.Time.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td><td>{{printf "%.3fs" .DurationSeconds}}</td><td>{{.Error}}</td><td>{{.ScrapeID}}</td></tr>
+{{end}}</table>
+</body>
+</html>`))
+
+// targetsHandler lists the targets with their last scrape outcome, as HTML
+// or, for clients asking for application/json, as JSON. Credentials in
+// target URLs are redacted.
+func targetsHandler(targets *targetsCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries := targets.entries()
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Source < entries[j].Source })
+		if acceptsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(entries)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		targetsPage.Execute(w, entries)
+	}
+}
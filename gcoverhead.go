@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gcOverhead derives the share of time the JVM spends in GC pauses from the
+// total pause time and the uptime gathered during a scrape.
+type gcOverhead struct {
+	ratio prometheus.Gauge
+
+	pauseSeconds  float64
+	uptimeSeconds float64
+	uptimeKnown   bool
+}
+
+func newGCOverhead(constLabels prometheus.Labels) *gcOverhead {
+	return &gcOverhead{
+		ratio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "jvm_gc_overhead_ratio",
+			Help:        "GC pause time divided by the time spent outside GC pauses since the JVM started",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+func (g *gcOverhead) reset() {
+	g.pauseSeconds, g.uptimeSeconds, g.uptimeKnown = 0, 0, false
+}
+
+// update sets the ratio from the values gathered by the last scrape, or to
+// 0 when the uptime is unknown.
+func (g *gcOverhead) update() {
+	running := g.uptimeSeconds - g.pauseSeconds
+	if !g.uptimeKnown || running <= 0 {
+		g.ratio.Set(0)
+		return
+	}
+	g.ratio.Set(g.pauseSeconds / running)
+}
+
+// gatherBoot1 reads the GC times and uptime, in milliseconds, from a Spring
+// Boot 1.x /metrics map. There is one gc.<collector>.time key per garbage
+// collector.
+func (g *gcOverhead) gatherBoot1(metrics map[string]interface{}) {
+	for k, v := range metrics {
+		ms, ok := numberValue(v)
+		if !ok {
+			continue
+		}
+		switch {
+		case k == "uptime":
+			g.uptimeSeconds, g.uptimeKnown = ms/1000, true
+		case strings.HasPrefix(k, "gc.") && strings.HasSuffix(k, ".time"):
+			g.pauseSeconds += ms / 1000
+		}
+	}
+}
+
+// gatherGCOverheadMeters fetches the total jvm.gc.pause time and
+// process.uptime from a Spring Boot 2.x actuator.
+func (e *Exporter) gatherGCOverheadMeters(available map[string]bool) {
+	g := e.gcOverhead
+	if available["jvm.gc.pause"] {
+		var m meterResponse
+		if err := e.fetchMeter("jvm.gc.pause", nil, &m); err != nil {
+			slog.ErrorContext(e.logContext(), "Can't scrape meter", "target", redactURL(e.URL), "meter", "jvm.gc.pause", "err", redactError(err))
+			e.partialFailure(false)
+		}
+		for _, s := range m.Measurements {
+			if s.Statistic == "TOTAL_TIME" && !s.invalid {
+				g.pauseSeconds = s.Value
+			}
+		}
+	}
+	if available["process.uptime"] {
+		var m meterResponse
+		if err := e.fetchMeter("process.uptime", nil, &m); err != nil {
+			slog.ErrorContext(e.logContext(), "Can't scrape meter", "target", redactURL(e.URL), "meter", "process.uptime", "err", redactError(err))
+			e.partialFailure(false)
+		} else if len(m.Measurements) > 0 && !m.Measurements[0].invalid {
+			g.uptimeSeconds, g.uptimeKnown = m.Measurements[0].Value, true
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGCOverhead(t *testing.T) {
+	// Spring Boot 2: 30s of pauses in 630s of uptime.
+	ts := fixtureServer(t, "testdata/gc_overhead.json")
+	e := NewExporter(ts.URL+"/actuator/metrics", Options{Timeout: time.Second})
+	if v, ok := findMetric(gather(t, e), "spring_actuator_jvm_gc_overhead_ratio", nil); !ok || v != 30.0/600 {
+		t.Errorf("Spring Boot 2 ratio = %v (found %v), want %v", v, ok, 30.0/600)
+	}
+
+	// Spring Boot 1: 5s of pauses over two collectors in 100s of uptime.
+	boot1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mem": 1, "uptime": 100000, "gc.ps_scavenge.count": 40, "gc.ps_scavenge.time": 3000, "gc.ps_marksweep.count": 2, "gc.ps_marksweep.time": 2000}`))
+	}))
+	defer boot1.Close()
+	e = NewExporter(boot1.URL+"/metrics", Options{Timeout: time.Second})
+	if v, ok := findMetric(gather(t, e), "spring_actuator_jvm_gc_overhead_ratio", nil); !ok || v != 5.0/95 {
+		t.Errorf("Spring Boot 1 ratio = %v (found %v), want %v", v, ok, 5.0/95)
+	}
+
+	// Without the uptime the ratio is 0.
+	g := newGCOverhead(nil)
+	g.pauseSeconds = 30
+	g.update()
+	if v, ok := findMetric(gather(t, g.ratio), "spring_actuator_jvm_gc_overhead_ratio", nil); !ok || v != 0 {
+		t.Errorf("ratio without uptime = %v (found %v), want 0", v, ok)
+	}
+}
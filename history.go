@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// historyEntry is the outcome of one scrape of a target.
+type historyEntry struct {
+	Target           string    `json:"target"`
+	Timestamp        time.Time `json:"timestamp"`
+	Up               bool      `json:"up"`
+	ScrapeDurationMs float64   `json:"scrape_duration_ms"`
+	MetricsCount     int       `json:"metrics_count"`
+}
+
+// scrapeHistory keeps the last scrapes of a target in a ring buffer.
+type scrapeHistory struct {
+	mu      sync.RWMutex
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+// newScrapeHistory returns a history of size entries, or nil if size isn't
+// positive.
+func newScrapeHistory(size int) *scrapeHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &scrapeHistory{entries: make([]historyEntry, size)}
+}
+
+func (h *scrapeHistory) add(entry historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Entries returns the recorded scrapes, oldest first.
+func (h *scrapeHistory) Entries() []historyEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.full {
+		return append([]historyEntry(nil), h.entries[:h.next]...)
+	}
+	return append(append([]historyEntry(nil), h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// recordHistory counts the metrics collect sends through the returned
+// channel to ch and, once done is called, records the scrape in the
+// history. Without a history ch is returned as is.
+func (e *Exporter) recordHistory(ch chan<- prometheus.Metric) (counted chan<- prometheus.Metric, done func()) {
+	if e.history == nil {
+		return ch, func() {}
+	}
+	c := make(chan prometheus.Metric)
+	forwarded := make(chan int)
+	go func() {
+		var n int
+		for m := range c {
+			n++
+			ch <- m
+		}
+		forwarded <- n
+	}()
+	return c, func() {
+		close(c)
+		n := <-forwarded
+		st := e.Status()
+		e.history.add(historyEntry{
+			Target:           st.URL,
+			Timestamp:        st.Time,
+			Up:               st.Up,
+			ScrapeDurationMs: st.DurationSeconds * 1000,
+			MetricsCount:     n,
+		})
+	}
+}
+
+// historyHandler serves the scrape history of every target, or of the one
+// given in the target parameter, as JSON sorted by time.
+func historyHandler(targets *targetsCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		entries := []historyEntry{}
+		for _, e := range targets.exporters() {
+			if e.history == nil || (target != "" && redactURL(target) != redactURL(e.URL)) {
+				continue
+			}
+			entries = append(entries, e.history.Entries()...)
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
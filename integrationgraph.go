@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// integrationGraphRetryInterval is how long an application without the
+// integrationgraph endpoint is left alone in auto mode.
+const integrationGraphRetryInterval = time.Hour
+
+// integrationGraph is the part of /actuator/integrationgraph we look at.
+type integrationGraph struct {
+	Nodes []struct {
+		Input  *string `json:"input"`
+		Output *string `json:"output"`
+	} `json:"nodes"`
+}
+
+type integrationGraphMetrics struct {
+	enabled     featureFlag
+	components  *prometheus.GaugeVec
+	lastRefresh prometheus.Gauge
+	refreshed   bool
+	missingAt   time.Time
+}
+
+func newIntegrationGraphMetrics(opts Options) *integrationGraphMetrics {
+	return &integrationGraphMetrics{
+		enabled:    opts.IntegrationGraph,
+		components: newMetrics("integration_graph_components", "Spring Integration components by type", opts.ConstLabels, []string{"component_type"}),
+		lastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "integration_graph_last_refresh_seconds",
+			Help:        "Time the Spring Integration graph was last fetched since unix epoch in seconds",
+			ConstLabels: opts.ConstLabels,
+		}),
+	}
+}
+
+// componentType sorts a graph node into channel, endpoint or handler:
+// channels have neither input nor output, endpoints that consume from a
+// channel carry a message handler, and the others (gateways, inbound
+// adapters) only produce messages.
+func componentType(input, output *string) string {
+	switch {
+	case input != nil:
+		return "handler"
+	case output != nil:
+		return "endpoint"
+	default:
+		return "channel"
+	}
+}
+
+// scrapeIntegrationGraph counts the components of the Spring Integration
+// graph. In auto mode a missing endpoint is only asked for again after
+// integrationGraphRetryInterval.
+func (e *Exporter) scrapeIntegrationGraph() {
+	g := e.integrationGraph
+	if g.enabled == featureOff {
+		return
+	}
+	if g.enabled == featureAuto && !g.missingAt.IsZero() && time.Since(g.missingAt) < integrationGraphRetryInterval {
+		return
+	}
+	var graph integrationGraph
+	if err := e.fetchJSON(e.endpointURL("integrationgraph"), &graph); err != nil {
+		if err == errNotFound && g.enabled == featureAuto {
+			slog.DebugContext(e.logContext(), "No integrationgraph endpoint", "target", redactURL(e.URL))
+			g.missingAt = time.Now()
+			return
+		}
+		e.errorLogs.log(e.logContext(), "endpoint integrationgraph", "Can't scrape endpoint", "target", redactURL(e.URL), "endpoint", "integrationgraph", "err", redactError(err))
+		return
+	}
+	e.errorLogs.ok("endpoint integrationgraph")
+	g.missingAt = time.Time{}
+	counts := map[string]int{"channel": 0, "endpoint": 0, "handler": 0}
+	for _, n := range graph.Nodes {
+		counts[componentType(n.Input, n.Output)]++
+	}
+	for t, c := range counts {
+		g.components.WithLabelValues(t).Set(float64(c))
+	}
+	g.lastRefresh.SetToCurrentTime()
+	g.refreshed = true
+}
+
+func (g *integrationGraphMetrics) collect(ch chan<- prometheus.Metric) {
+	g.components.Collect(ch)
+	if g.refreshed {
+		ch <- g.lastRefresh
+	}
+}
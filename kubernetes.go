@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Pod annotations read by the Kubernetes discovery.
+const (
+	scrapeAnnotation = "spring-actuator/scrape"
+	portAnnotation   = "spring-actuator/port"
+	pathAnnotation   = "spring-actuator/path"
+	schemeAnnotation = "spring-actuator/scheme"
+)
+
+// kubernetesDiscovery finds running pods annotated with
+// spring-actuator/scrape=true through pod informers, one per namespace.
+type kubernetesDiscovery struct {
+	listers     []listers.PodLister
+	appLabel    string
+	defaultPath string
+}
+
+// newKubernetesClient uses the in-cluster configuration, or kubeconfig if
+// given.
+func newKubernetesClient(kubeconfig string) (*kubernetes.Clientset, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+	if kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// newKubernetesDiscovery starts pod informers for namespaces, or for all
+// namespaces if there are none, until ctx is cancelled. onChange is called
+// whenever a pod is added, updated or deleted.
+func newKubernetesDiscovery(ctx context.Context, client kubernetes.Interface, namespaces []string, resync time.Duration, appLabel, defaultPath string, onChange func()) (*kubernetesDiscovery, error) {
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	d := &kubernetesDiscovery{appLabel: appLabel, defaultPath: defaultPath}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { onChange() },
+		UpdateFunc: func(interface{}, interface{}) { onChange() },
+		DeleteFunc: func(interface{}) { onChange() },
+	}
+	for _, ns := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(client, resync, informers.WithNamespace(ns))
+		pods := factory.Core().V1().Pods()
+		pods.Informer().AddEventHandler(handler)
+		d.listers = append(d.listers, pods.Lister())
+		factory.Start(ctx.Done())
+		for typ, ok := range factory.WaitForCacheSync(ctx.Done()) {
+			if !ok {
+				return nil, fmt.Errorf("can't sync %v informer for namespace %q", typ, ns)
+			}
+		}
+	}
+	return d, nil
+}
+
+// target returns the actuator of pod, if it is to be scraped.
+func (d *kubernetesDiscovery) target(pod *v1.Pod) (discoveredTarget, bool) {
+	if pod.Annotations[scrapeAnnotation] != "true" || pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+		return discoveredTarget{}, false
+	}
+	port, err := strconv.Atoi(pod.Annotations[portAnnotation])
+	if err != nil {
+		return discoveredTarget{}, false
+	}
+	scheme := pod.Annotations[schemeAnnotation]
+	if scheme == "" {
+		scheme = "http"
+	}
+	path := pod.Annotations[pathAnnotation]
+	if path == "" {
+		path = d.defaultPath
+	}
+	return discoveredTarget{
+		URL: scheme + "://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port)) + path,
+		Labels: map[string]string{
+			"namespace": pod.Namespace,
+			"pod":       pod.Name,
+			"app":       pod.Labels[d.appLabel],
+		},
+	}, true
+}
+
+// discover lists the annotated pods from the informer caches.
+func (d *kubernetesDiscovery) discover(context.Context) ([]discoveredTarget, error) {
+	var targets []discoveredTarget
+	for _, l := range d.listers {
+		pods, err := l.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range pods {
+			if t, ok := d.target(pod); ok {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets, nil
+}
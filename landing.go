@@ -0,0 +1,28 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var landingPage = template.Must(template.New("landing").Parse(`<html>
+<head><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Description}}</p>
+<p><a href="{{.MetricsPath}}">Metrics</a></p>
+<p><a href="/dump">Dump (CSV)</a></p>
+<p><a href="/targets">Targets</a></p>
+<p>Probe: /probe?target=http://host:port/actuator/metrics</p>
+</body>
+</html>`))
+
+// landingHandler serves the root page, with the title and description
+// given on the command line.
+func landingHandler(title, description, metricsPath string) http.HandlerFunc {
+	data := struct{ Title, Description, MetricsPath string }{title, description, metricsPath}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		landingPage.Execute(w, data)
+	}
+}
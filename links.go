@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// actuatorIndex is the HATEOAS document served at the actuator root.
+type actuatorIndex struct {
+	Links map[string]struct {
+		Href      string `json:"href"`
+		Templated bool   `json:"templated"`
+	} `json:"_links"`
+}
+
+// discoverEndpoints fetches the actuator root and returns the href of each
+// endpoint it links to, by name. Templated links, such as health-path,
+// are left out. A root without links gives errNotFound.
+func (e *Exporter) discoverEndpoints(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.endpointURL(""), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		return nil, statusError(resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var index actuatorIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, err
+	}
+	if len(index.Links) == 0 {
+		return nil, errNotFound
+	}
+	links := make(map[string]string, len(index.Links))
+	for name, l := range index.Links {
+		if name != "self" && !l.Templated && l.Href != "" {
+			links[name] = l.Href
+		}
+	}
+	return links, nil
+}
+
+// refreshLinks discovers the endpoints again once the cached links are
+// older than the TTL. An actuator without links is asked again after the
+// TTL too; on other errors the previous links are kept and the next scrape
+// tries again.
+func (e *Exporter) refreshLinks() {
+	if e.linksTTL <= 0 || (!e.linksFetchedAt.IsZero() && time.Since(e.linksFetchedAt) < e.linksTTL) {
+		return
+	}
+	ctx := e.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	links, err := e.discoverEndpoints(ctx)
+	if err != nil && err != errNotFound {
+		slog.DebugContext(e.logContext(), "Can't discover the endpoints", "target", redactURL(e.URL), "err", redactError(err))
+		return
+	}
+	e.links, e.linksFetchedAt = links, time.Now()
+}
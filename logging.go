@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// newLogger returns a logger writing to w the messages of level and above,
+// in format logfmt or json.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q, must be debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "logfmt":
+		return slog.New(scrapeIDHandler{slog.NewTextHandler(w, opts)}), nil
+	case "json":
+		return slog.New(scrapeIDHandler{slog.NewJSONHandler(w, opts)}), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, must be logfmt or json", format)
+}
+
+type scrapeIDKey struct{}
+
+// newScrapeID returns a short ID for one scrape of a target.
+func newScrapeID() string {
+	return randomHex(4)
+}
+
+// withScrapeID marks ctx as the context of the scrape id. Log lines given
+// this context carry the ID in a scrape_id field.
+func withScrapeID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, scrapeIDKey{}, id)
+}
+
+// scrapeIDHandler adds the scrape ID of the context, if any, to every
+// record.
+type scrapeIDHandler struct {
+	slog.Handler
+}
+
+func (h scrapeIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(scrapeIDKey{}).(string); ok {
+		r.AddAttrs(slog.String("scrape_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h scrapeIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return scrapeIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h scrapeIDHandler) WithGroup(name string) slog.Handler {
+	return scrapeIDHandler{h.Handler.WithGroup(name)}
+}
+
+// logContext returns the context to log with: that of the scrape in
+// progress, if any.
+func (e *Exporter) logContext() context.Context {
+	if e.ctx != nil {
+		return e.ctx
+	}
+	return context.Background()
+}
+
+// fatal logs msg with args at error level and exits. Only main's startup
+// path may give up like this; everything else logs and carries on.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	removePIDFile()
+	os.Exit(1)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repeatedLogsSize bounds the number of distinct repeated messages
+// remembered; the least recently seen are forgotten first.
+const repeatedLogsSize = 10000
+
+// repeatedLogs remembers the repeated messages already logged, such as the
+// skipped keys of each target, so that a big payload doesn't log the same
+// lines on every scrape.
+var repeatedLogs = newOnceSet(repeatedLogsSize)
+
+// onceSet is a bounded set of keys, evicting the least recently seen.
+type onceSet struct {
+	mu    sync.Mutex
+	max   int
+	order *list.List
+	seen  map[string]*list.Element
+	// disabled makes every key look new, for -log.repeated.
+	disabled bool
+}
+
+func newOnceSet(max int) *onceSet {
+	return &onceSet{max: max, order: list.New(), seen: make(map[string]*list.Element)}
+}
+
+// first reports whether key wasn't seen before, or was forgotten since.
+func (s *onceSet) first(key string) bool {
+	if s.disabled {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.seen[key]; ok {
+		s.order.MoveToFront(el)
+		return false
+	}
+	s.seen[key] = s.order.PushFront(key)
+	if s.order.Len() > s.max {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.seen, oldest.Value.(string))
+	}
+	return true
+}
+
+// logOnce logs msg at level the first time key is seen, noting that
+// further occurrences are suppressed. Counters are left to track them.
+func logOnce(ctx context.Context, level slog.Level, key, msg string, args ...interface{}) {
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+	if !repeatedLogs.first(key) {
+		return
+	}
+	if !repeatedLogs.disabled {
+		args = append(args, "note", "further occurrences are suppressed")
+	}
+	slog.Log(ctx, level, msg, args...)
+}
+
+// errorSamplingInterval is how often an error that keeps happening on a
+// target is logged again, for -log.error-sampling-interval. 0 logs every
+// occurrence.
+var errorSamplingInterval = 5 * time.Minute
+
+// errorSampler limits the logs of the errors of one target that happen on
+// every scrape: the first error of a kind is logged at once, then a
+// summary once per errorSamplingInterval while it goes on.
+type errorSampler struct {
+	mu sync.Mutex
+	// since is when each kind of error started failing, logged when it was
+	// last logged and suppressed how many were left out since.
+	since      map[string]time.Time
+	logged     map[string]time.Time
+	suppressed map[string]int
+}
+
+func newErrorSampler() *errorSampler {
+	return &errorSampler{
+		since:      make(map[string]time.Time),
+		logged:     make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// log logs msg at error level unless an error of the same kind was logged
+// less than errorSamplingInterval ago. Repeats are logged with how long
+// the errors have been going on and how many were suppressed.
+func (s *errorSampler) log(ctx context.Context, kind, msg string, args ...interface{}) {
+	s.mu.Lock()
+	now := time.Now()
+	since, failing := s.since[kind]
+	if failing && errorSamplingInterval > 0 && now.Sub(s.logged[kind]) < errorSamplingInterval {
+		s.suppressed[kind]++
+		s.mu.Unlock()
+		return
+	}
+	if failing {
+		args = append(args, "failing_for", now.Sub(since).Round(time.Second), "suppressed", s.suppressed[kind])
+	} else {
+		s.since[kind] = now
+	}
+	s.logged[kind] = now
+	s.suppressed[kind] = 0
+	s.mu.Unlock()
+	slog.ErrorContext(ctx, msg, args...)
+}
+
+// ok forgets the errors whose kind starts with prefix, so that the next one
+// is logged at once.
+func (s *errorSampler) ok(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for kind := range s.since {
+		if strings.HasPrefix(kind, prefix) {
+			delete(s.since, kind)
+			delete(s.logged, kind)
+			delete(s.suppressed, kind)
+		}
+	}
+}
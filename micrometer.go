@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// featureFlag is a tri-state command-line flag: auto (the default), on or
+// off. Passing the flag without a value turns the feature on.
+type featureFlag int
+
+const (
+	featureAuto featureFlag = iota
+	featureOn
+	featureOff
+)
+
+func (f *featureFlag) String() string {
+	switch *f {
+	case featureOn:
+		return "true"
+	case featureOff:
+		return "false"
+	default:
+		return "auto"
+	}
+}
+
+func (f *featureFlag) Set(s string) error {
+	if s == "auto" {
+		*f = featureAuto
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("must be true, false or auto")
+	}
+	if b {
+		*f = featureOn
+	} else {
+		*f = featureOff
+	}
+	return nil
+}
+
+func (f *featureFlag) IsBoolFlag() bool { return true }
+
+// measurement is a statistic of a meter. A value that isn't a number, such
+// as the "NaN" Jackson writes for an empty gauge, makes it invalid rather
+// than failing the whole response. A number sent as a string is read.
+type measurement struct {
+	Statistic string
+	Value     float64
+	invalid   bool
+}
+
+func (m *measurement) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Statistic string          `json:"statistic"`
+		Value     json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	m.Statistic = raw.Statistic
+	m.invalid = raw.Value == nil || bytes.Equal(raw.Value, []byte("null")) || json.Unmarshal(raw.Value, &m.Value) != nil
+	var s string
+	if m.invalid && json.Unmarshal(raw.Value, &s) == nil {
+		var ok bool
+		m.Value, ok = numericString(s)
+		m.invalid = !ok
+	}
+	return nil
+}
+
+// meterResponse is the body of /actuator/metrics/{name} in Spring Boot 2.x.
+type meterResponse struct {
+	Name          string        `json:"name"`
+	Description   string        `json:"description"`
+	BaseUnit      string        `json:"baseUnit"`
+	Measurements  []measurement `json:"measurements"`
+	AvailableTags []struct {
+		Tag    string   `json:"tag"`
+		Values []string `json:"values"`
+	} `json:"availableTags"`
+}
+
+// meterMetric maps the statistics of one Micrometer meter, broken down by
+// the given tags, to Prometheus gauges, or counters for cumulative
+// statistics that should survive resets of the meter.
+type meterMetric struct {
+	meter string
+	tags  []string
+	// labelValues are added after the tag values, for meters sharing their
+	// metrics with others told apart by these labels.
+	labelValues []string
+	// generic meters, such as those of any connection pool, don't make an
+	// auto group active.
+	generic  bool
+	stats    map[string]*prometheus.GaugeVec
+	counters map[string]*prometheus.CounterVec
+	// last holds the previous value of each counted statistic, by
+	// statistic and tag values, so only increases are added.
+	last map[string]float64
+	// growth is how much the counted statistics grew since the previous
+	// scrape, 0 until they have been seen twice.
+	growth float64
+}
+
+// meterGroup is a set of meters exported together behind one enable flag.
+// In auto mode the group is scraped when any of its meters is listed by the
+// actuator.
+type meterGroup struct {
+	name    string
+	enabled featureFlag
+	metrics []*meterMetric
+}
+
+func newTimerMetric(meter, name, help string, constLabels prometheus.Labels, tags []string) *meterMetric {
+	labels := tagLabels(tags)
+	return &meterMetric{
+		meter: meter,
+		tags:  tags,
+		stats: map[string]*prometheus.GaugeVec{
+			"COUNT":      newMetrics(name+"_seconds_count", help, constLabels, labels),
+			"TOTAL_TIME": newMetrics(name+"_seconds_sum", help, constLabels, labels),
+		},
+	}
+}
+
+func newGaugeMetric(meter, name, help string, constLabels prometheus.Labels, tags []string) *meterMetric {
+	return &meterMetric{
+		meter: meter,
+		tags:  tags,
+		stats: map[string]*prometheus.GaugeVec{
+			"VALUE": newMetrics(name, help, constLabels, tagLabels(tags)),
+		},
+	}
+}
+
+// newCounterMetric exports the COUNT of a FunctionCounter as a counter. The
+// actuator reports the current cumulative value, which starts over when
+// the application restarts; the counter is only increased by the growth
+// seen between scrapes.
+func newCounterMetric(meter, name, help string, constLabels prometheus.Labels, tags []string) *meterMetric {
+	return &meterMetric{
+		meter: meter,
+		tags:  tags,
+		counters: map[string]*prometheus.CounterVec{
+			"COUNT": prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace:   namespace,
+				Name:        name + "_total",
+				Help:        help,
+				ConstLabels: constLabels,
+			}, tagLabels(tags)),
+		},
+		last: make(map[string]float64),
+	}
+}
+
+// count adds the growth of a cumulative statistic to its counter.
+func (m *meterMetric) count(statistic string, labelValues []string, value float64) {
+	c, ok := m.counters[statistic]
+	if !ok {
+		return
+	}
+	key := statistic + "\xff" + strings.Join(labelValues, "\xff")
+	delta := value
+	if prev, ok := m.last[key]; ok && value >= prev {
+		delta = value - prev
+		m.growth += delta
+	}
+	m.last[key] = value
+	if delta > 0 {
+		c.WithLabelValues(labelValues...).Add(delta)
+	}
+}
+
+func newMeterGroups(opts Options) []*meterGroup {
+	timer := func(meter, name, help string, tags []string) *meterMetric {
+		return newTimerMetric(meter, opts.Renames.rename(meter, name), help, opts.ConstLabels, tags)
+	}
+	gauge := func(meter, name, help string, tags []string) *meterMetric {
+		return newGaugeMetric(meter, opts.Renames.rename(meter, name), help, opts.ConstLabels, tags)
+	}
+	counter := func(meter, name, help string, tags []string) *meterMetric {
+		return newCounterMetric(meter, opts.Renames.rename(meter, name), help, opts.ConstLabels, tags)
+	}
+	redisConnections := gauge("lettuce.connections", "redis_connections", "Redis client connections", []string{"state"})
+	// Jedis has no command timers; the commons-pool2 gauges of its
+	// connection pool give its connections by state.
+	jedisPool := func(meter, state string) *meterMetric {
+		return &meterMetric{meter: meter, labelValues: []string{state}, generic: true, stats: redisConnections.stats}
+	}
+	groups := []*meterGroup{
+		{
+			name: "mongodb",
+			metrics: []*meterMetric{
+				timer("mongodb.driver.commands", "mongodb_driver_commands", "MongoDB driver command execution time", []string{"command", "cluster.id", "status"}),
+			},
+		},
+		{
+			name: "redis",
+			metrics: []*meterMetric{
+				timer("lettuce.command.completion", "redis_command_completion", "Redis command completion time", []string{"command", "status"}),
+				timer("lettuce.command.firstresponse", "redis_command_firstresponse", "Redis command time to first response", []string{"command", "status"}),
+				redisConnections,
+				jedisPool("commons.pool2.num.active", "active"),
+				jedisPool("commons.pool2.num.idle", "idle"),
+			},
+		},
+		{
+			name: "config-client",
+			metrics: []*meterMetric{
+				counter("spring.cloud.config.client.requests", "config_client_requests", "Requests of the Spring Cloud Config client to the config server", nil),
+				counter("spring.cloud.config.client.failures", "config_client_failures", "Failed requests of the Spring Cloud Config client to the config server", nil),
+			},
+		},
+		{
+			name: "tomcat-sessions",
+			metrics: []*meterMetric{
+				gauge("tomcat.sessions.active.current", "tomcat_sessions_active_current", "Active Tomcat sessions", nil),
+				gauge("tomcat.sessions.active.max", "tomcat_sessions_active_max", "Maximum number of active Tomcat sessions at the same time", nil),
+				gauge("tomcat.sessions.alive.max", "tomcat_sessions_alive_max_seconds", "Longest time an expired Tomcat session had been alive", nil),
+				counter("tomcat.sessions.created", "tomcat_sessions_created", "Tomcat sessions created", nil),
+				counter("tomcat.sessions.expired", "tomcat_sessions_expired", "Tomcat sessions expired", nil),
+				counter("tomcat.sessions.rejected", "tomcat_sessions_rejected", "Tomcat sessions rejected because the maximum number of active sessions was reached", nil),
+			},
+		},
+	}
+	for _, g := range groups {
+		g.enabled = opts.MeterGroups[g.name]
+	}
+	return groups
+}
+
+func knownMeterGroup(name string) bool {
+	for _, g := range newMeterGroups(Options{}) {
+		if g.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tagLabels turns Micrometer tag keys into Prometheus label names.
+func tagLabels(tags []string) []string {
+	labels := make([]string, len(tags))
+	for i, t := range tags {
+		labels[i] = strings.NewReplacer(".", "_", "-", "_").Replace(t)
+	}
+	return labels
+}
+
+func (g *meterGroup) active(names map[string]bool) bool {
+	switch g.enabled {
+	case featureOn:
+		return true
+	case featureOff:
+		return false
+	}
+	for _, m := range g.metrics {
+		if names[m.meter] && !m.generic {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Exporter) meterCounters() []*prometheus.CounterVec {
+	var vecs []*prometheus.CounterVec
+	for _, g := range e.meterGroups {
+		for _, m := range g.metrics {
+			for _, v := range m.counters {
+				vecs = append(vecs, v)
+			}
+		}
+	}
+	return vecs
+}
+
+// meterVecs returns the gauges of the meters, each once even if several
+// meters share it.
+func (e *Exporter) meterVecs() []*prometheus.GaugeVec {
+	var vecs []*prometheus.GaugeVec
+	seen := make(map[*prometheus.GaugeVec]bool)
+	for _, g := range e.meterGroups {
+		for _, m := range g.metrics {
+			for _, v := range m.stats {
+				if !seen[v] {
+					seen[v] = true
+					vecs = append(vecs, v)
+				}
+			}
+		}
+	}
+	return vecs
+}
+
+// scrapeMeters fetches the meters of every active group from a Spring Boot
+// 2.x /actuator/metrics endpoint, whose index lists the available names.
+func (e *Exporter) scrapeMeters(names []string) {
+	available := make(map[string]bool, len(names))
+	for _, n := range names {
+		available[n] = true
+	}
+	if available["process.start.time"] && e.included("process.start.time") && (!e.startTimeKnown || e.noCacheStatic) {
+		var m meterResponse
+		if err := e.fetchMeter("process.start.time", nil, &m); err != nil {
+			slog.ErrorContext(e.logContext(), "Can't scrape meter", "target", redactURL(e.URL), "meter", "process.start.time", "err", redactError(err))
+			e.partialFailure(false)
+		} else if len(m.Measurements) > 0 && !m.Measurements[0].invalid {
+			e.startTime.Set(m.Measurements[0].Value)
+			e.startTimeKnown = true
+		}
+	}
+	e.gatherGCOverheadMeters(available)
+	if e.allMeters != nil {
+		e.discoverMeters(names)
+	}
+	var wanted []*meterMetric
+	for _, g := range e.meterGroups {
+		for _, m := range g.metrics {
+			m.growth = 0
+		}
+		if !g.active(available) {
+			continue
+		}
+		for _, m := range g.metrics {
+			if available[m.meter] && e.included(m.meter) {
+				wanted = append(wanted, m)
+			}
+		}
+	}
+	samples, errs := e.fetchMeters(wanted)
+	for i, m := range wanted {
+		if errs[i] != nil {
+			slog.ErrorContext(e.logContext(), "Can't scrape meter", "target", redactURL(e.URL), "meter", m.meter, "err", redactError(errs[i]))
+			e.partialFailure(false)
+			continue
+		}
+		e.exportMeter(m, samples[i])
+	}
+	e.updateConfigRefresh()
+}
+
+// fetchMeters fetches the samples of meters, up to e.meterParallelism
+// meters at a time. The samples and error of each meter are at its index.
+func (e *Exporter) fetchMeters(meters []*meterMetric) ([][]meterSample, []error) {
+	samples := make([][]meterSample, len(meters))
+	errs := make([]error, len(meters))
+	workers := e.meterParallelism
+	if workers < 1 {
+		workers = 1
+	}
+	next := make(chan int, len(meters))
+	for i := range meters {
+		next <- i
+	}
+	close(next)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(meters); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				samples[i], errs[i] = e.fetchMeterSamples(meters[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return samples, errs
+}
+
+// findMeter returns the metric of the meter name, or nil.
+func (e *Exporter) findMeter(name string) *meterMetric {
+	for _, g := range e.meterGroups {
+		for _, m := range g.metrics {
+			if m.meter == name {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// meterSample holds the measurements of a meter for one combination of
+// tag values.
+type meterSample struct {
+	tagValues    []string
+	measurements []measurement
+}
+
+// fetchMeterSamples fetches the measurements of every combination of the
+// tags of m. It only reads m, so meters can be fetched concurrently.
+func (e *Exporter) fetchMeterSamples(m *meterMetric) ([]meterSample, error) {
+	var index meterResponse
+	if err := e.fetchMeter(m.meter, nil, &index); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]string)
+	for _, t := range index.AvailableTags {
+		values[t.Tag] = t.Values
+	}
+	// Query every combination of the wanted tags; tags the meter doesn't
+	// carry are exported with an empty label value.
+	combos := [][]string{{}}
+	for _, t := range m.tags {
+		vs := values[t]
+		if len(vs) == 0 {
+			vs = []string{""}
+		}
+		var next [][]string
+		for _, c := range combos {
+			for _, v := range vs {
+				next = append(next, append(append([]string{}, c...), v))
+			}
+		}
+		combos = next
+		if e.maxTagCombinations > 0 && len(combos) > e.maxTagCombinations {
+			logOnce(e.logContext(), slog.LevelWarn, "combinations "+e.URL+" "+m.meter, "Meter has too many tag combinations, only the first are scraped", "target", redactURL(e.URL), "meter", m.meter, "max", e.maxTagCombinations)
+			combos = combos[:e.maxTagCombinations]
+		}
+	}
+	var samples []meterSample
+	for _, c := range combos {
+		query := url.Values{}
+		for i, t := range m.tags {
+			if c[i] != "" {
+				query.Add("tag", t+":"+c[i])
+			}
+		}
+		var resp meterResponse
+		if err := e.fetchMeter(m.meter, query, &resp); err != nil {
+			if err == errNotFound {
+				continue
+			}
+			return nil, err
+		}
+		samples = append(samples, meterSample{c, resp.Measurements})
+	}
+	return samples, nil
+}
+
+// exportMeter sets the metrics of m from its samples.
+func (e *Exporter) exportMeter(m *meterMetric, samples []meterSample) {
+	for _, sample := range samples {
+		c := sample.tagValues
+		if len(m.labelValues) > 0 {
+			c = append(append([]string{}, c...), m.labelValues...)
+		}
+		for _, s := range sample.measurements {
+			if s.invalid {
+				logOnce(e.logContext(), slog.LevelDebug, "nan "+e.URL+" "+m.meter+" "+s.Statistic, "Skipping value: not a number", "target", redactURL(e.URL), "meter", m.meter, "statistic", s.Statistic)
+				e.partialFailure(true)
+				continue
+			}
+			if v, ok := m.stats[s.Statistic]; ok {
+				v.WithLabelValues(c...).Set(s.Value)
+			}
+			e.receivedValue(m.meter, s.Value)
+			e.changes.observe(fmt.Sprintf("%s%v %s", m.meter, c, s.Statistic), s.Value)
+			m.count(s.Statistic, c, s.Value)
+		}
+	}
+}
+
+func (e *Exporter) fetchMeter(name string, query url.Values, v interface{}) error {
+	u := strings.TrimSuffix(e.URL, "/") + "/" + url.PathEscape(name)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return e.fetchJSON(u, v)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fixtureServer serves the actuator responses of a testdata file: a JSON
+// object from request path, with the tag queries in order as in
+// "/actuator/metrics/jvm.memory.used?tag=area:heap", to response body.
+// Other requests get a 404.
+func fixtureServer(t *testing.T, file string) *httptest.Server {
+	t.Helper()
+	responses := loadFixture(t, file)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveFixture(w, r, responses)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func loadFixture(t *testing.T, file string) map[string]json.RawMessage {
+	t.Helper()
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses map[string]json.RawMessage
+	if err := json.Unmarshal(b, &responses); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return responses
+}
+
+func serveFixture(w http.ResponseWriter, r *http.Request, responses map[string]json.RawMessage) {
+	key := r.URL.Path
+	if tags := r.URL.Query()["tag"]; len(tags) > 0 {
+		key += "?tag=" + strings.Join(tags, "&tag=")
+	}
+	body, ok := responses[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// gather collects c once and returns the metric families.
+func gather(t *testing.T, c prometheus.Collector) []*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+// findMetric returns the value of the series of name with at least the
+// given labels.
+func findMetric(mfs []*dto.MetricFamily, name string, labels map[string]string) (float64, bool) {
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.Metric {
+			have := make(map[string]string, len(m.Label))
+			for _, l := range m.Label {
+				have[l.GetName()] = l.GetValue()
+			}
+			for k, v := range labels {
+				if have[k] != v {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Gauge != nil:
+				return m.Gauge.GetValue(), true
+			case m.Counter != nil:
+				return m.Counter.GetValue(), true
+			case m.Untyped != nil:
+				return m.Untyped.GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestRedisMeters(t *testing.T) {
+	type series struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}
+	for _, tc := range []struct {
+		fixture string
+		enabled featureFlag
+		want    []series
+		absent  []string
+	}{
+		{
+			fixture: "testdata/redis_lettuce.json",
+			want: []series{
+				{"spring_actuator_redis_command_completion_seconds_count", map[string]string{"command": "GET", "status": "SUCCESS"}, 1200},
+				{"spring_actuator_redis_command_completion_seconds_sum", map[string]string{"command": "SET", "status": "SUCCESS"}, 0.317},
+				{"spring_actuator_redis_command_firstresponse_seconds_count", map[string]string{"command": "SET", "status": "SUCCESS"}, 330},
+				{"spring_actuator_redis_connections", map[string]string{"state": "active"}, 3},
+				{"spring_actuator_redis_connections", map[string]string{"state": "idle"}, 7},
+			},
+		},
+		{
+			// A commons-pool2 pool alone doesn't tell it is Jedis.
+			fixture: "testdata/redis_jedis.json",
+			absent:  []string{"spring_actuator_redis_connections"},
+		},
+		{
+			fixture: "testdata/redis_jedis.json",
+			enabled: featureOn,
+			want: []series{
+				{"spring_actuator_redis_connections", map[string]string{"state": "active"}, 2},
+				{"spring_actuator_redis_connections", map[string]string{"state": "idle"}, 6},
+			},
+			absent: []string{"spring_actuator_redis_command_completion_seconds_count"},
+		},
+	} {
+		ts := fixtureServer(t, tc.fixture)
+		e := NewExporter(ts.URL+"/actuator/metrics", Options{
+			Timeout:     time.Second,
+			MeterGroups: map[string]featureFlag{"redis": tc.enabled},
+		})
+		mfs := gather(t, e)
+		if v, _ := findMetric(mfs, "spring_actuator_up", nil); v != 1 {
+			t.Fatalf("%s: up = %v", tc.fixture, v)
+		}
+		for _, s := range tc.want {
+			v, ok := findMetric(mfs, s.name, s.labels)
+			if !ok || v != s.value {
+				t.Errorf("%s (redis %s): %s%v = %v (found %v), want %v", tc.fixture, &tc.enabled, s.name, s.labels, v, ok, s.value)
+			}
+		}
+		for _, name := range tc.absent {
+			if _, ok := findMetric(mfs, name, nil); ok {
+				t.Errorf("%s (redis %s): unexpected %s", tc.fixture, &tc.enabled, name)
+			}
+		}
+	}
+}
+
+func TestMongoDBMeters(t *testing.T) {
+	ts := fixtureServer(t, "testdata/mongodb.json")
+	e := NewExporter(ts.URL+"/actuator/metrics", Options{Timeout: time.Second})
+	mfs := gather(t, e)
+	cluster := "65f1c0a2b7e4d93a1c8e4f10"
+	for _, s := range []struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}{
+		{"spring_actuator_mongodb_driver_commands_seconds_count", map[string]string{"command": "find", "cluster_id": cluster, "status": "SUCCESS"}, 4210},
+		{"spring_actuator_mongodb_driver_commands_seconds_sum", map[string]string{"command": "find", "cluster_id": cluster, "status": "SUCCESS"}, 8.42},
+		{"spring_actuator_mongodb_driver_commands_seconds_count", map[string]string{"command": "find", "cluster_id": cluster, "status": "FAILED"}, 3},
+		{"spring_actuator_mongodb_driver_commands_seconds_count", map[string]string{"command": "insert", "cluster_id": cluster, "status": "SUCCESS"}, 812},
+		{"spring_actuator_mongodb_driver_commands_seconds_sum", map[string]string{"command": "update", "cluster_id": cluster, "status": "SUCCESS"}, 1.3},
+	} {
+		if v, ok := findMetric(mfs, s.name, s.labels); !ok || v != s.value {
+			t.Errorf("%s%v = %v (found %v), want %v", s.name, s.labels, v, ok, s.value)
+		}
+	}
+	if _, ok := findMetric(mfs, "spring_actuator_mongodb_driver_commands_seconds_count", map[string]string{"command": "insert", "status": "FAILED"}); ok {
+		t.Error("series exported for a tag combination the target doesn't have")
+	}
+
+	// Disabled, the meters aren't fetched even though the target has them.
+	e = NewExporter(ts.URL+"/actuator/metrics", Options{Timeout: time.Second, MeterGroups: map[string]featureFlag{"mongodb": featureOff}})
+	if _, ok := findMetric(gather(t, e), "spring_actuator_mongodb_driver_commands_seconds_count", nil); ok {
+		t.Error("mongodb meters exported with the group disabled")
+	}
+}
+
+// The session counters follow the growth of the FunctionCounters, and keep
+// growing across a restart of the application.
+func TestTomcatSessionMeters(t *testing.T) {
+	responses := loadFixture(t, "testdata/tomcat_sessions.json")
+	var mu sync.Mutex
+	created := 48210.0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/actuator/metrics/tomcat.sessions.created" {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(w, `{"name": "tomcat.sessions.created", "measurements": [{"statistic": "COUNT", "value": %v}]}`, created)
+			return
+		}
+		serveFixture(w, r, responses)
+	}))
+	defer ts.Close()
+
+	e := NewExporter(ts.URL+"/actuator/metrics", Options{Timeout: time.Second})
+	mfs := gather(t, e)
+	for name, want := range map[string]float64{
+		"spring_actuator_tomcat_sessions_active_current":    1843,
+		"spring_actuator_tomcat_sessions_active_max":        2500,
+		"spring_actuator_tomcat_sessions_alive_max_seconds": 3605,
+		"spring_actuator_tomcat_sessions_created_total":     48210,
+		"spring_actuator_tomcat_sessions_expired_total":     46367,
+		"spring_actuator_tomcat_sessions_rejected_total":    12,
+	} {
+		if v, ok := findMetric(mfs, name, nil); !ok || v != want {
+			t.Errorf("%s = %v (found %v), want %v", name, v, ok, want)
+		}
+	}
+
+	for _, step := range []struct {
+		created, want float64
+	}{
+		{48300, 48300},
+		{48300, 48300},
+		// The application restarted and counts from 0 again.
+		{25, 48325},
+		{40, 48340},
+	} {
+		mu.Lock()
+		created = step.created
+		mu.Unlock()
+		v, _ := findMetric(gather(t, e), "spring_actuator_tomcat_sessions_created_total", nil)
+		if v != step.want {
+			t.Errorf("after tomcat.sessions.created = %v: counter = %v, want %v", step.created, v, step.want)
+		}
+	}
+}
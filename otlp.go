@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// parseHeaders parses a comma-separated list of key=value pairs.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, want key=value", kv)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// otlpPusher periodically gathers the registered metrics and sends them to
+// an OTLP gRPC endpoint, such as an OpenTelemetry Collector.
+type otlpPusher struct {
+	gatherer prometheus.Gatherer
+	exporter *otlpmetricgrpc.Exporter
+	resource *resource.Resource
+	start    time.Time
+	timeout  time.Duration
+}
+
+func newOTLPPusher(ctx context.Context, g prometheus.Gatherer, endpoint string, headers map[string]string, timeout time.Duration, insecure bool) (*otlpPusher, error) {
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(endpoint),
+		otlpmetricgrpc.WithTimeout(timeout),
+	}
+	if len(headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(headers))
+	}
+	if insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	exp, err := otlpmetricgrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &otlpPusher{
+		gatherer: g,
+		exporter: exp,
+		resource: resource.NewSchemaless(attribute.String("service.name", "spring_actuator_exporter")),
+		start:    time.Now(),
+		timeout:  timeout,
+	}, nil
+}
+
+// run pushes every interval until ctx is cancelled, then shuts the
+// exporter down.
+func (p *otlpPusher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), p.timeout)
+			defer cancel()
+			if err := p.exporter.Shutdown(shutdownCtx); err != nil {
+				slog.Error("Can't shut the OTLP exporter down", "err", err)
+			}
+			return
+		case <-ticker.C:
+			if err := p.push(ctx); err != nil {
+				slog.Error("Can't push metrics over OTLP", "err", err)
+			}
+		}
+	}
+}
+
+func (p *otlpPusher) push(ctx context.Context) error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	rm := &metricdata.ResourceMetrics{
+		Resource: p.resource,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: "github.com/yu74n/spring_actuator_exporter"},
+			Metrics: convertMetricFamilies(mfs, p.start, time.Now()),
+		}},
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return p.exporter.Export(ctx, rm)
+}
+
+// convertMetricFamilies turns gathered Prometheus metrics into OTLP data.
+// Gauges and untyped metrics become gauges, counters cumulative monotonic
+// sums starting at start, and summaries and histograms keep their shape.
+func convertMetricFamilies(mfs []*dto.MetricFamily, start, now time.Time) []metricdata.Metrics {
+	metrics := make([]metricdata.Metrics, 0, len(mfs))
+	for _, mf := range mfs {
+		m := metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp()}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+			for _, pm := range mf.GetMetric() {
+				sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: attributes(pm), StartTime: start, Time: now, Value: pm.GetCounter().GetValue(),
+				})
+			}
+			m.Data = sum
+		case dto.MetricType_SUMMARY:
+			var summary metricdata.Summary
+			for _, pm := range mf.GetMetric() {
+				s := pm.GetSummary()
+				dp := metricdata.SummaryDataPoint{
+					Attributes: attributes(pm), StartTime: start, Time: now,
+					Count: s.GetSampleCount(), Sum: s.GetSampleSum(),
+				}
+				for _, q := range s.GetQuantile() {
+					dp.QuantileValues = append(dp.QuantileValues, metricdata.QuantileValue{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+				summary.DataPoints = append(summary.DataPoints, dp)
+			}
+			m.Data = summary
+		case dto.MetricType_HISTOGRAM:
+			hist := metricdata.Histogram[float64]{Temporality: metricdata.CumulativeTemporality}
+			for _, pm := range mf.GetMetric() {
+				h := pm.GetHistogram()
+				dp := metricdata.HistogramDataPoint[float64]{
+					Attributes: attributes(pm), StartTime: start, Time: now,
+					Count: h.GetSampleCount(), Sum: h.GetSampleSum(),
+				}
+				// Prometheus buckets are cumulative, OTLP ones are not, and
+				// the +Inf bucket is implicit in OTLP.
+				var prev uint64
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						continue
+					}
+					dp.Bounds = append(dp.Bounds, b.GetUpperBound())
+					dp.BucketCounts = append(dp.BucketCounts, b.GetCumulativeCount()-prev)
+					prev = b.GetCumulativeCount()
+				}
+				dp.BucketCounts = append(dp.BucketCounts, h.GetSampleCount()-prev)
+				hist.DataPoints = append(hist.DataPoints, dp)
+			}
+			m.Data = hist
+		default:
+			var gauge metricdata.Gauge[float64]
+			for _, pm := range mf.GetMetric() {
+				v := pm.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					v = pm.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: attributes(pm), Time: now, Value: v,
+				})
+			}
+			m.Data = gauge
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func attributes(m *dto.Metric) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		kvs = append(kvs, attribute.String(lp.GetName(), lp.GetValue()))
+	}
+	return attribute.NewSet(kvs...)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// targetAllowlist restricts which hosts /probe may scrape. Patterns are
+// host or host:port globs as understood by path.Match, for example
+// "*.apps.internal" or "10.0.0.5:8081". An empty list allows any target.
+type targetAllowlist []string
+
+func parseTargetAllowlist(s string) (targetAllowlist, error) {
+	var l targetAllowlist
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+		l = append(l, p)
+	}
+	return l, nil
+}
+
+func (l targetAllowlist) allows(u *url.URL) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, p := range l {
+		if ok, _ := path.Match(p, u.Host); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, u.Hostname()); ok && !strings.Contains(p, ":") {
+			return true
+		}
+	}
+	return false
+}
+
+// probeTimeout returns the timeout of a probe: the timeout parameter if
+// given, else def, capped at max and at the scrape timeout Prometheus
+// announces in X-Prometheus-Scrape-Timeout-Seconds minus offset, so the
+// exporter answers before Prometheus gives up.
+func probeTimeout(r *http.Request, def, max, offset time.Duration) (time.Duration, error) {
+	timeout := def
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil || timeout <= 0 {
+			return 0, fmt.Errorf("invalid timeout %q", t)
+		}
+	}
+	if max > 0 && timeout > max {
+		timeout = max
+	}
+	if limit, ok := scrapeTimeout(r, offset); ok && timeout > limit {
+		timeout = limit
+	}
+	return timeout, nil
+}
+
+// scrapeTimeout returns the scrape timeout Prometheus sent along with r,
+// minus offset, if it did and that leaves any time.
+func scrapeTimeout(r *http.Request, offset time.Duration) (time.Duration, bool) {
+	h := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if h == "" {
+		return 0, false
+	}
+	secs, err := strconv.ParseFloat(h, 64)
+	if err != nil || secs <= 0 {
+		return 0, false
+	}
+	limit := time.Duration(secs*float64(time.Second)) - offset
+	return limit, limit > 0
+}
+
+// moduleOptions applies the probe module name of cfg to opts. Without a
+// name the default module is used if there is one.
+func moduleOptions(opts Options, cfg *targetsConfig, name string) (Options, error) {
+	var modules map[string]*scrapeConfig
+	if cfg != nil {
+		modules = cfg.Modules
+		opts.MetricOverrides = cfg.MetricOverrides
+	}
+	if name == "" {
+		name = defaultModule
+		if _, ok := modules[name]; !ok {
+			return opts, nil
+		}
+	}
+	m, ok := modules[name]
+	if !ok {
+		var valid []string
+		if cfg != nil {
+			valid = cfg.moduleNames()
+		}
+		return opts, fmt.Errorf("unknown module %q, valid modules: %s", name, strings.Join(valid, ", "))
+	}
+	o, err := m.options(opts)
+	if err != nil {
+		return opts, fmt.Errorf("module %q: %v", name, err)
+	}
+	return o, nil
+}
+
+// probeExporters keeps the exporter of each probed target, module and
+// timeout, with -actuator.min-scrape-interval, while the result of its last
+// scrape can still be served.
+type probeExporters struct {
+	mu        sync.Mutex
+	exporters map[string]*Exporter
+}
+
+// get returns the exporter kept under key, or a new one from build.
+// Exporters with nothing left to serve are dropped on the way.
+func (p *probeExporters) get(key string, build func() *Exporter) *Exporter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, e := range p.exporters {
+		if _, ok := e.cachedMetrics(); !ok && k != key {
+			delete(p.exporters, k)
+			e.Close()
+		}
+	}
+	e, ok := p.exporters[key]
+	if !ok {
+		e = build()
+		p.exporters[key] = e
+	}
+	return e
+}
+
+// scrapeIDWriter sets the X-Scrape-ID header to the ID of the last scrape
+// of e when the response is written, which promhttp only does once
+// gathering is over.
+type scrapeIDWriter struct {
+	http.ResponseWriter
+	e       *Exporter
+	written bool
+}
+
+func (w *scrapeIDWriter) WriteHeader(code int) {
+	if !w.written {
+		w.written = true
+		if id := w.e.Status().ScrapeID; id != "" {
+			w.Header().Set("X-Scrape-ID", id)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *scrapeIDWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// probeHandler scrapes the actuator given in the target parameter and
+// serves the result, blackbox_exporter style. Each probe gets its own
+// Exporter and registry, so nothing is shared with /metrics except the HTTP
+// client and settings in opts. With a minimum scrape interval the exporter
+// of a target is kept to serve its last result again, unless refresh=true.
+func probeHandler(opts Options, allowlist targetAllowlist, maxTimeout, timeoutOffset time.Duration, config func() *targetsConfig) http.HandlerFunc {
+	cache := &probeExporters{exporters: make(map[string]*Exporter)}
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		target := params.Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, fmt.Sprintf("invalid target %q", target), http.StatusBadRequest)
+			return
+		}
+		if !allowlist.allows(u) {
+			http.Error(w, fmt.Sprintf("target %q is not allowed", target), http.StatusForbidden)
+			return
+		}
+
+		probeOpts, err := moduleOptions(opts, config(), params.Get("module"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		def := probeOpts.TotalTimeout
+		if def <= 0 {
+			def = probeOpts.Timeout
+		}
+		timeout, err := probeTimeout(r, def, maxTimeout, timeoutOffset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		probeOpts.TotalTimeout = timeout
+		probeOpts.ScrapeInterval = 0
+		// A probe exporter only lives for one scrape.
+		probeOpts.HistorySize = 0
+
+		registry := prometheus.NewRegistry()
+		timeoutGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "probe_timeout_seconds",
+			Help:      "Timeout used for this probe",
+		})
+		timeoutGauge.Set(timeout.Seconds())
+		var e *Exporter
+		if probeOpts.MinScrapeInterval > 0 {
+			e = cache.get(fmt.Sprintf("%s %s %s", target, params.Get("module"), timeout), func() *Exporter {
+				return NewExporter(target, probeOpts)
+			})
+		} else {
+			e = NewExporter(target, probeOpts)
+			defer e.Close()
+		}
+		// The scrape is abandoned if Prometheus gives up on the probe.
+		registry.MustRegister(requestCollector{e, r.Context(), params.Get("refresh") == "true"}, timeoutGauge)
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(&scrapeIDWriter{ResponseWriter: w, e: e}, r)
+	}
+}
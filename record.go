@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordSuffix ends the names of recorded responses. Other files in the
+// record directory are left alone.
+const recordSuffix = ".response.json"
+
+// recorder writes the raw response bodies of the targets to disk for
+// -debug.record-dir, or is nil.
+var recorder *responseRecorder
+
+// responseRecorder writes response bodies to dir, one file per response
+// named after the time, target and endpoint. The oldest files are removed
+// once there are more than maxFiles or they take more than maxBytes. Only
+// bodies are written, never the request or response headers.
+type responseRecorder struct {
+	dir      string
+	maxFiles int
+	maxBytes int64
+
+	mu sync.Mutex
+	// files are the recorded files, oldest first, and bytes their size.
+	files []recordedFile
+	bytes int64
+}
+
+type recordedFile struct {
+	name string
+	size int64
+}
+
+// newResponseRecorder creates dir if needed. Files recorded by an earlier
+// run count towards the limits.
+func newResponseRecorder(dir string, maxFiles int, maxBytes int64) (*responseRecorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &responseRecorder{dir: dir, maxFiles: maxFiles, maxBytes: maxBytes}
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), recordSuffix) {
+			r.files = append(r.files, recordedFile{fi.Name(), fi.Size()})
+			r.bytes += fi.Size()
+		}
+	}
+	// Names start with the time, so they sort oldest first.
+	sort.Slice(r.files, func(i, j int) bool { return r.files[i].name < r.files[j].name })
+	r.mu.Lock()
+	r.prune()
+	r.mu.Unlock()
+	return r, nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._=-]+`)
+
+// record writes body, received from endpoint of target at t.
+func (r *responseRecorder) record(t time.Time, target, endpoint string, body []byte) {
+	if r.maxBytes > 0 && int64(len(body)) > r.maxBytes {
+		slog.Warn("Response too large to record", "target", target, "endpoint", endpoint, "bytes", len(body), "max_bytes", r.maxBytes)
+		return
+	}
+	name := t.UTC().Format("20060102T150405.000000000Z") + "_" +
+		unsafeFileChars.ReplaceAllString(target, "_") + "_" +
+		unsafeFileChars.ReplaceAllString(endpoint, "_") + recordSuffix
+	if err := ioutil.WriteFile(filepath.Join(r.dir, name), body, 0600); err != nil {
+		slog.Warn("Can't record response", "target", target, "endpoint", endpoint, "err", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files = append(r.files, recordedFile{name, int64(len(body))})
+	r.bytes += int64(len(body))
+	r.prune()
+}
+
+// prune removes the oldest files until the limits are met. r.mu must be
+// held.
+func (r *responseRecorder) prune() {
+	for len(r.files) > 0 && (r.maxFiles > 0 && len(r.files) > r.maxFiles || r.maxBytes > 0 && r.bytes > r.maxBytes) {
+		f := r.files[0]
+		if err := os.Remove(filepath.Join(r.dir, f.name)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Can't remove recorded response", "file", f.name, "err", err)
+		}
+		r.files = r.files[1:]
+		r.bytes -= f.size
+	}
+}
+
+// recordingBody keeps a copy of what is read from a response body and
+// records it when the body is closed.
+type recordingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	start    time.Time
+	target   string
+	endpoint string
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	recorder.record(b.start, b.target, b.endpoint, b.buf.Bytes())
+	return b.ReadCloser.Close()
+}
+
+// recordEndpoint names the endpoint of u in the name of a recorded file:
+// as for the request metrics, but with the meter and tags of single meters.
+func (e *Exporter) recordEndpoint(u string) string {
+	endpoint := e.endpointOf(u)
+	if endpoint == "metric-detail" {
+		endpoint += "_" + strings.TrimPrefix(u, strings.TrimSuffix(e.URL, "/")+"/")
+	}
+	return endpoint
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redacted replaces secrets in log lines and scrape errors, as
+// url.URL.Redacted does for passwords.
+const redacted = "xxxxx"
+
+// userinfoRE matches the password of a URL with credentials.
+var userinfoRE = regexp.MustCompile(`(//[^/@\s:]*):[^/@\s]*@`)
+
+// knownSecrets are the credentials the exporter was given: passwords of
+// target URLs, credentials of the targets file and of discovery. They are
+// redacted wherever they appear, including inside error messages of other
+// packages. The URLs of /probe come from whoever calls it, so their
+// passwords aren't added; they are only hidden where the URL appears.
+var knownSecrets = &secretSet{secrets: make(map[string]struct{})}
+
+type secretSet struct {
+	mu      sync.RWMutex
+	secrets map[string]struct{}
+	// sorted lists the secrets longest first, so that a secret containing
+	// another is replaced whole.
+	sorted []string
+}
+
+func (s *secretSet) add(secrets ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, secret := range secrets {
+		if _, ok := s.secrets[secret]; ok || secret == "" {
+			continue
+		}
+		s.secrets[secret] = struct{}{}
+		s.sorted = append(s.sorted, secret)
+	}
+	sort.Slice(s.sorted, func(i, j int) bool { return len(s.sorted[i]) > len(s.sorted[j]) })
+}
+
+// addBasicAuth registers a password along with the Authorization header
+// value it ends up in.
+func (s *secretSet) addBasicAuth(username, password string) {
+	if password == "" {
+		return
+	}
+	s.add(password, base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+}
+
+// addURL registers the password of rawurl, if it has one.
+func (s *secretSet) addURL(rawurl string) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return
+	}
+	if password, ok := u.User.Password(); ok {
+		s.addBasicAuth(u.User.Username(), password)
+	}
+}
+
+func (s *secretSet) replace(str string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, secret := range s.sorted {
+		str = strings.Replace(str, secret, redacted, -1)
+	}
+	return str
+}
+
+// redact hides the passwords of URLs and every known secret in s. Anything
+// logged or served that may hold a URL or an error goes through it.
+func redact(s string) string {
+	return knownSecrets.replace(userinfoRE.ReplaceAllString(s, "${1}:"+redacted+"@"))
+}
+
+// redactError returns the message of err, redacted.
+func redactError(err error) string {
+	return redact(err.Error())
+}
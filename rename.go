@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// renameCheckInterval is how often the rename file is checked for changes.
+const renameCheckInterval = 10 * time.Second
+
+// renameRule renames the metric exported for every actuator key or meter
+// name matching From. From is an anchored regular expression and To may
+// refer to its capture groups ($1). To is the name under the
+// spring_actuator_ namespace.
+type renameRule struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	re   *regexp.Regexp
+}
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// renameRules holds the rules loaded from a rename file. A nil
+// *renameRules renames nothing.
+type renameRules struct {
+	path string
+
+	mu      sync.RWMutex
+	rules   []renameRule
+	modTime time.Time
+}
+
+func loadRenameRules(path string) (*renameRules, error) {
+	r := &renameRules{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func parseRenameRules(b []byte) ([]renameRule, error) {
+	var rules []renameRule
+	if err := yaml.UnmarshalStrict(b, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		re, err := regexp.Compile("^(?:" + rules[i].From + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid from %q: %v", i, rules[i].From, err)
+		}
+		if rules[i].To == "" {
+			return nil, fmt.Errorf("rule %d: to is required", i)
+		}
+		rules[i].re = re
+	}
+	return rules, nil
+}
+
+func (r *renameRules) reload() error {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parseRenameRules(b)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.rules, r.modTime = rules, fi.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+// rename returns the metric name to use for the actuator key, or name if no
+// rule matches. The first matching rule wins.
+func (r *renameRules) rename(key, name string) string {
+	if r == nil {
+		return name
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rule := range r.rules {
+		m := rule.re.FindStringSubmatchIndex(key)
+		if m == nil {
+			continue
+		}
+		renamed := string(rule.re.ExpandString(nil, rule.To, key, m))
+		if !metricNameRE.MatchString(renamed) {
+			slog.Error("Rename is not a valid metric name, keeping the original", "key", key, "rename", renamed, "metric", name)
+			return name
+		}
+		return renamed
+	}
+	return name
+}
+
+// watch reloads the rules whenever the file's modification time changes
+// and calls onChange after a successful reload. A file that fails to parse
+// leaves the previous rules in place.
+func (r *renameRules) watch(ctx context.Context, onChange func()) {
+	ticker := time.NewTicker(renameCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(r.path)
+		if err != nil {
+			slog.Error("Can't check rename file", "file", r.path, "err", err)
+			continue
+		}
+		r.mu.RLock()
+		changed := !fi.ModTime().Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			slog.Error("Can't reload rename file, keeping previous rules", "file", r.path, "err", err)
+			continue
+		}
+		slog.Info("Reloaded rename rules", "file", r.path)
+		onChange()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// replayTransport answers the requests of an exporter from files instead
+// of the network, for -actuator.input-file, so that everything after the
+// fetch behaves as with a live target. path is either a file, served for
+// the metrics endpoint, or a directory with a file per endpoint.
+type replayTransport struct {
+	path   string
+	target string
+	// endpoint names the endpoint of a URL like recorded files do.
+	endpoint func(u string) string
+}
+
+// replayFile returns the file answering the request for endpoint, or ""
+// if there is none. In a directory, endpoint.json comes first, then the
+// latest response of the target recorded with -debug.record-dir.
+func (t *replayTransport) replayFile(endpoint string) (string, error) {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		if endpoint == "metrics" {
+			return t.path, nil
+		}
+		return "", nil
+	}
+	name := unsafeFileChars.ReplaceAllString(endpoint, "_")
+	plain := filepath.Join(t.path, name+".json")
+	if _, err := os.Stat(plain); err == nil {
+		return plain, nil
+	}
+	recorded, err := filepath.Glob(filepath.Join(t.path, "*_"+unsafeFileChars.ReplaceAllString(t.target, "_")+"_"+name+recordSuffix))
+	if err != nil || len(recorded) == 0 {
+		return "", err
+	}
+	// Recorded names start with the time.
+	sort.Strings(recorded)
+	return recorded[len(recorded)-1], nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	file, err := t.replayFile(t.endpoint(req.URL.String()))
+	if err != nil {
+		return nil, err
+	}
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Request:    req,
+	}
+	if file == "" {
+		resp.StatusCode, resp.Status = http.StatusNotFound, "404 Not Found"
+		resp.Body = ioutil.NopCloser(strings.NewReader(""))
+		return resp, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	resp.StatusCode, resp.Status = http.StatusOK, "200 OK"
+	resp.Body, resp.ContentLength = f, fi.Size()
+	return resp, nil
+}
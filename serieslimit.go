@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// seriesLimit caps the number of series of each gathering through it. It is
+// a safety net against a misbehaving target flooding Prometheus, evaluated
+// anew on every gathering so the exposition recovers by itself.
+type seriesLimit struct {
+	max      int
+	exceeded prometheus.Gauge
+	registry *prometheus.Registry
+}
+
+func newSeriesLimit(max int) *seriesLimit {
+	l := &seriesLimit{
+		max: max,
+		exceeded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "series_limit_exceeded",
+			Help:      "Whether the last exposition was truncated to -actuator.max-series series (1 for yes, 0 for no)",
+		}),
+		registry: prometheus.NewRegistry(),
+	}
+	l.registry.MustRegister(l.exceeded)
+	return l
+}
+
+// wrap returns a Gatherer that keeps the series gathered by g up to the
+// limit, in the order of g, and reports whether anything was left out.
+func (l *seriesLimit) wrap(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		var kept []*dto.MetricFamily
+		var truncated []string
+		room := l.max
+		for _, mf := range mfs {
+			switch {
+			case room == 0:
+				truncated = append(truncated, mf.GetName())
+				continue
+			case len(mf.Metric) > room:
+				truncated = append(truncated, mf.GetName())
+				mf = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Unit: mf.Unit, Metric: mf.Metric[:room]}
+			}
+			room -= len(mf.Metric)
+			kept = append(kept, mf)
+		}
+		if len(truncated) > 0 {
+			slog.Warn("Exposition exceeds -actuator.max-series, truncated metric families", "max", l.max, "families", strings.Join(truncated, ","))
+			l.exceeded.Set(1)
+		} else {
+			l.exceeded.Set(0)
+		}
+		own, _ := l.registry.Gather()
+		return append(kept, own...), err
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type snapshot struct {
+	families []*dto.MetricFamily
+	taken    time.Time
+}
+
+// snapshotGatherer gathers from the wrapped Gatherer in the background and
+// serves the latest result, so a slow actuator never holds up /metrics.
+type snapshotGatherer struct {
+	gatherer prometheus.Gatherer
+	current  atomic.Value // *snapshot
+
+	registry *prometheus.Registry
+	age      prometheus.Gauge
+}
+
+func newSnapshotGatherer(g prometheus.Gatherer) *snapshotGatherer {
+	s := &snapshotGatherer{
+		gatherer: g,
+		registry: prometheus.NewRegistry(),
+		age: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "snapshot_age_seconds",
+			Help:      "Age of the metrics snapshot being served",
+		}),
+	}
+	s.registry.MustRegister(s.age)
+	return s
+}
+
+func (s *snapshotGatherer) update() {
+	mfs, err := s.gatherer.Gather()
+	if err != nil {
+		slog.Error("Gathering snapshot failed", "err", err)
+		if len(mfs) == 0 {
+			return
+		}
+	}
+	s.current.Store(&snapshot{families: mfs, taken: time.Now()})
+}
+
+// run takes a snapshot every interval until ctx is cancelled.
+func (s *snapshotGatherer) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.update()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Gather returns the latest snapshot together with its age. Until the first
+// snapshot is taken only the age is returned.
+func (s *snapshotGatherer) Gather() ([]*dto.MetricFamily, error) {
+	snap, _ := s.current.Load().(*snapshot)
+	var mfs []*dto.MetricFamily
+	if snap != nil {
+		s.age.Set(time.Since(snap.taken).Seconds())
+		mfs = append(mfs, snap.families...)
+	}
+	own, err := s.registry.Gather()
+	return append(mfs, own...), err
+}
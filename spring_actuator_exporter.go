@@ -1,137 +1,1461 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+	"gopkg.in/yaml.v2"
 )
 
 const (
 	namespace = "spring_actuator"
+
+	// writeTimeoutSlack is the minimum headroom -web.write-timeout should
+	// leave over -actuator.timeout to render and send the exposition.
+	writeTimeoutSlack = 5 * time.Second
 )
 
 type Exporter struct {
-	URL           string
-	up            prometheus.Gauge
+	URL string
+	// labels are the constant labels of every series of the target.
+	labels      prometheus.Labels
+	up          prometheus.Gauge
+	duration    prometheus.Gauge
+	lastAttempt prometheus.Gauge
+	// responseBytes and httpStatus describe the response of the metrics
+	// endpoint in the last scrape, totalBytes every response of it.
+	responseBytes prometheus.Gauge
+	totalBytes    prometheus.Gauge
+	httpStatus    prometheus.Gauge
+	// certExpiry is the certificate expiry of an HTTPS metrics endpoint in
+	// the last scrape.
+	certExpiry *prometheus.GaugeVec
+	// scrapeBytes counts, atomically, the bytes read in the scrape in
+	// progress.
+	scrapeBytes   int64
+	lastSuccess   prometheus.Gauge
+	snapshotAge   prometheus.Gauge
+	scrapeErrors  *prometheus.CounterVec
+	breaker       *circuitBreaker
+	aborted       prometheus.Counter
+	parseErrors   prometheus.Counter
+	requestTime   *prometheus.HistogramVec
+	requests      *prometheus.CounterVec
 	springMetrics map[string]*prometheus.GaugeVec
-	client        *http.Client
+	// multipliers scale the values of Spring Boot 1.x keys with a metric
+	// override.
+	multipliers    map[string]float64
+	valuesReceived *prometheus.CounterVec
+	// values, if set, is the distribution of the values received.
+	values *prometheus.HistogramVec
+	// changes, if set, logs the values that changed a lot between scrapes.
+	changes     *valueChanges
+	meterGroups []*meterGroup
+	client      *http.Client
+	// ownsClient is set if client serves this exporter only.
+	ownsClient bool
+	// errorLogs samples the logs of the errors repeated on every scrape.
+	errorLogs *errorSampler
+	// partialFailures counts, atomically, the values and meters that failed
+	// in the scrape in progress. With strictUp they make the target down.
+	partialFailures int64
+	strictUp        bool
+
+	attemptTimeout   time.Duration
+	totalTimeout     time.Duration
+	tracePropagation bool
+	// ctx is the context of the scrape in progress, if any.
+	ctx context.Context
+
+	scrapeInterval time.Duration
+	scrapeJitter   time.Duration
+	snapshotMaxAge time.Duration
+	bgMu           sync.Mutex
+	bg             *backgroundScrape
+
+	// cached holds the metrics of the last successful scrape, served again
+	// until it is minScrapeInterval old.
+	minScrapeInterval time.Duration
+	cacheMu           sync.Mutex
+	cached            []prometheus.Metric
+	cachedAt          time.Time
+
+	// flight is the scrape in progress, if any.
+	flightMu      sync.Mutex
+	flight        *scrapeFlight
+	sharedScrapes prometheus.Counter
+
+	// collectMu serializes scrapes and everything else touching the
+	// scraped state, since concurrent /metrics requests, the startup probe
+	// and the target sets before and after a reload share the exporter.
+	collectMu sync.Mutex
+
+	statusMu   sync.Mutex
+	lastScrape scrapeStatus
+	history    *scrapeHistory
+	// hasSucceededOnce is set, atomically, once the actuator has answered.
+	hasSucceededOnce int32
+
+	actuatorVersion string
+	metricInclude   []string
+	renames         *renameRules
+
+	// allMeters, if set, exports every meter the actuator lists.
+	allMeters          *discoveredMeters
+	maxTagCombinations int
+	// meterParallelism bounds how many meters are fetched at a time.
+	meterParallelism int
+
+	// links are the endpoint hrefs listed at the actuator root, if any.
+	links          map[string]string
+	linksTTL       time.Duration
+	linksFetchedAt time.Time
+
+	noCacheStatic  bool
+	startTime      prometheus.Gauge
+	startTimeKnown bool
+
+	integrationGraph *integrationGraphMetrics
+	beans            *beansMetrics
+	gcOverhead       *gcOverhead
+	configRefresh    *configRefresh
+	endpointUp       *prometheus.GaugeVec
+	notExposed       *prometheus.GaugeVec
+	health           *healthMetrics
+	info             *infoMetrics
+
+	versionInfo      *prometheus.GaugeVec
+	version          springVersion
+	versionCheckedAt time.Time
+	// appContextSeen is set, atomically, once a response carried the
+	// X-Application-Context header of Spring Boot 1.x.
+	appContextSeen int32
+}
+
+// boot1Metric is a key of the Spring Boot 1.x /metrics endpoint that is
+// exported, with the metric name and the value of its single label.
+type boot1Metric struct {
+	key, name, help, label string
+}
+
+// boot1Metrics are the exported keys besides those of garbage collectors.
+var boot1Metrics = []boot1Metric{
+	{"mem", "mem", "The total system memory in KB", "memory"},
+	{"mem.free", "mem_free", "The amount of free memory in KB", "memory"},
+	{"heap.committed", "heap_committed", "Heap information in KB", "memory"},
+	{"heap.used", "heap_used", "Heap information in KB", "memory"},
+	{"nonheap.committed", "nonheap_committed", "Non heap information in KB", "memory"},
+	{"nonheap.used", "nonheap_used", "Non heap information in KB", "memory"},
+	{"threads", "threads", "Thread information", "thread"},
+	{"classes", "classes", "Class load information", "classes"},
+	{"classes.loaded", "classes_loaded", "Class load information", "classes"},
+	{"classes.unloaded", "classes_unloaded", "Class load information", "classes"},
+	{"systemload.average", "systemload_average", "The average system load", "load_average"},
+}
+
+// defaultGCCollectors are the garbage collectors whose gc.<name>.count and
+// gc.<name>.time keys are exported by default. Spring Boot 1.x names them
+// after the JVM's collector, lower-cased with spaces replaced by "_": those
+// of the Parallel, G1, CMS and Serial collectors.
+var defaultGCCollectors = []string{
+	"ps_scavenge", "ps_marksweep",
+	"g1_young_generation", "g1_old_generation",
+	"parnew", "concurrentmarksweep",
+	"copy", "marksweepcompact",
+}
+
+var gcCollectorRE = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// parseGCCollectors parses a comma-separated list of garbage collector
+// names.
+func parseGCCollectors(s string) ([]string, error) {
+	var names []string
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		if !gcCollectorRE.MatchString(n) {
+			return nil, fmt.Errorf("invalid garbage collector name %q", n)
+		}
+		names = append(names, n)
+	}
+	return names, nil
+}
+
+// boot1MetricsFor returns the exported keys with those of the given
+// garbage collectors, or of the default ones if gcCollectors is nil.
+func boot1MetricsFor(gcCollectors []string) []boot1Metric {
+	if gcCollectors == nil {
+		gcCollectors = defaultGCCollectors
+	}
+	metrics := append([]boot1Metric{}, boot1Metrics...)
+	for _, gc := range gcCollectors {
+		metrics = append(metrics,
+			boot1Metric{"gc." + gc + ".count", "gc_" + gc + "_count", "Garbage collection information", "gc"},
+			boot1Metric{"gc." + gc + ".time", "gc_" + gc + "_time", "Garbage collection information", "gc"},
+		)
+	}
+	return metrics
+}
+
+// Options holds the settings of an Exporter beyond its scrape URL.
+type Options struct {
+	// Timeout bounds each request to the actuator.
+	Timeout time.Duration
+	// TotalTimeout bounds a whole scrape, retries included. 0 means no
+	// limit beyond Timeout.
+	TotalTimeout time.Duration
+	// Client, if set, is used instead of a new client built from Timeout.
+	// It is shared with other exporters unless ownsClient is set.
+	Client *http.Client
+	// Protocol selects the HTTP versions of clients built from Timeout.
+	Protocol actuatorProtocol
+	// TLSRenegotiation is the TLS renegotiation accepted by clients built
+	// from Timeout.
+	TLSRenegotiation tls.RenegotiationSupport
+	// GCCollectors are the garbage collectors whose Spring Boot 1.x keys
+	// are exported. nil exports those of defaultGCCollectors.
+	GCCollectors []string
+	// UnixSocket, if set, is where clients built from Timeout connect,
+	// whatever the host of the URL.
+	UnixSocket string
+	// StrictUp reports a target down when a value or a Spring Boot 2.x
+	// meter of a scrape failed, not only when the metrics endpoint did.
+	StrictUp bool
+	// InputPath, if set, is a file or directory whose content answers the
+	// requests instead of the target. Client is then ignored.
+	InputPath string
+	// NoRedirects makes clients built from Timeout fail on a 3xx answer
+	// instead of following it.
+	NoRedirects bool
+	// MaxRedirects is how many redirects in a row clients built from
+	// Timeout follow. 0 leaves Go's default of 10.
+	MaxRedirects int
+	// ResponseHeaderTimeout bounds the wait for the response headers of
+	// each request, within Timeout, which also covers reading the body.
+	// 0 leaves it to Timeout.
+	ResponseHeaderTimeout time.Duration
+	// MeterGroups enables or disables Spring Boot 2.x meter groups by name.
+	MeterGroups map[string]featureFlag
+	// NoCacheStatic re-fetches meters that can't change while the JVM
+	// runs, such as process.start.time, on every scrape.
+	NoCacheStatic bool
+	// Renames overrides the names of exported metrics. May be nil.
+	Renames *renameRules
+	// ConstLabels are added to every metric of the exporter, for instance
+	// to tell targets apart.
+	ConstLabels prometheus.Labels
+	// ScrapeInterval, if set, makes the exporter scrape in the background
+	// once started, and Collect serve the last results.
+	ScrapeInterval time.Duration
+	// ScrapeJitter delays the first background scrape by up to this much.
+	ScrapeJitter time.Duration
+	// SnapshotMaxAge, if set, reports the target down instead of serving
+	// a background scrape older than this.
+	SnapshotMaxAge time.Duration
+	// MinScrapeInterval, if set, makes Collect serve the last successful
+	// scrape again instead of scraping until it is this old.
+	MinScrapeInterval time.Duration
+	// LabelNames are constant labels every exporter of a registry must
+	// carry, since a metric family can't mix label sets. Those missing from
+	// ConstLabels get an empty value.
+	LabelNames []string
+	// ActuatorVersion forces the payload format: "1" for the Spring Boot
+	// 1.x /metrics map, "2" for the 2.x meter index. Empty detects it.
+	ActuatorVersion string
+	// MetricInclude, if not empty, limits the exported Spring Boot 1.x keys
+	// and meters to those matching one of these path.Match patterns.
+	MetricInclude []string
+	// IntegrationGraph enables counting the Spring Integration components
+	// listed by the integrationgraph endpoint.
+	IntegrationGraph featureFlag
+	// Beans enables counting the beans listed by the beans endpoint.
+	Beans bool
+	// Endpoints enables or disables the health and info endpoints by name.
+	Endpoints map[string]featureFlag
+	// HistorySize is how many scrapes are kept for /history. 0 keeps none.
+	HistorySize int
+	// EndpointLinksTTL is how long the endpoint links of the actuator root
+	// are cached. 0 doesn't look for links.
+	EndpointLinksTTL time.Duration
+	// AllMeters exports every meter listed by a Spring Boot 2.x actuator,
+	// not only those of the meter groups.
+	AllMeters bool
+	// MaxTagCombinations bounds how many tag combinations of a meter are
+	// fetched in a scrape. 0 means no limit.
+	MaxTagCombinations int
+	// MeterParallelism is how many Spring Boot 2.x meters of a target are
+	// fetched at a time.
+	MeterParallelism int
+	// CircuitBreakerFailures is how many scrapes in a row must fail before
+	// the target is only tried every CircuitBreakerBackoff. 0 disables the
+	// circuit breaker.
+	CircuitBreakerFailures int
+	CircuitBreakerBackoff  time.Duration
+	// ValueHistogram records the distribution of every value received, by
+	// Spring Boot 1.x key or meter name.
+	ValueHistogram bool
+	// ChangeThreshold, if positive, logs at debug level the values that
+	// changed by more than this percentage since the last successful scrape.
+	ChangeThreshold float64
+	// TracePropagation sends a W3C traceparent header with every request,
+	// one trace per scrape.
+	TracePropagation bool
+	// MetricOverrides change the unit of Spring Boot 1.x metrics. The first
+	// matching override applies.
+	MetricOverrides []*metricOverride
+	// ownsClient is set if Client was built for one exporter only.
+	ownsClient bool
 }
 
-func NewExporter(url string, timeout time.Duration) *Exporter {
-	return &Exporter{
-		URL: url,
+func NewExporter(url string, opts Options) *Exporter {
+	opts.ConstLabels = padLabels(opts.ConstLabels, opts.LabelNames)
+	client, ownsClient := opts.Client, opts.ownsClient
+	if client == nil {
+		client, ownsClient = newHTTPClient(opts, nil), true
+	}
+	var replay *replayTransport
+	if opts.InputPath != "" {
+		replay = &replayTransport{path: opts.InputPath, target: targetLabel(url)}
+		client, ownsClient = &http.Client{Transport: replay}, true
+	}
+	scrapeErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "scrape_errors_total",
+		Help:        "Scrapes of Spring Actuator that failed, by the step that failed",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"reason"})
+	for _, reason := range scrapeErrorReasons {
+		scrapeErrors.WithLabelValues(reason)
+	}
+	valuesReceived := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "metric_values_received_total",
+		Help:        "Values received from Spring Actuator and exported, by group of metrics",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"metric_group"})
+	for _, g := range metricGroups {
+		valuesReceived.WithLabelValues(g.group)
+	}
+	valuesReceived.WithLabelValues("custom")
+	exported := boot1MetricsFor(opts.GCCollectors)
+	springMetrics := make(map[string]*prometheus.GaugeVec, len(exported))
+	multipliers := make(map[string]float64)
+	for _, m := range exported {
+		name := opts.Renames.rename(m.key, m.name)
+		if o := findMetricOverride(opts.MetricOverrides, m.key); o != nil {
+			name = o.name(name)
+			multipliers[m.key] = o.multiplier()
+		}
+		springMetrics[m.key] = newMetrics(name, m.help, opts.ConstLabels, []string{m.label})
+	}
+	e := &Exporter{
+		URL:    url,
+		labels: opts.ConstLabels,
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "up",
-			Help:      "Was the last scrape of Spring Actuator successful",
+			Namespace:   namespace,
+			Name:        "up",
+			Help:        "Was the last scrape of Spring Actuator successful",
+			ConstLabels: opts.ConstLabels,
 		}),
-		springMetrics: map[string]*prometheus.GaugeVec{
-			"mem":                   newMetrics("mem", "The total system memory in KB", nil, []string{"memory"}),
-			"mem.free":              newMetrics("mem_free", "The amount of free memory in KB", nil, []string{"memory"}),
-			"heap.committed":        newMetrics("heap_committed", "Heap information in KB", nil, []string{"memory"}),
-			"heap.used":             newMetrics("heap_used", "Heap information in KB", nil, []string{"memory"}),
-			"nonheap.committed":     newMetrics("nonheap_committed", "Non heap information in KB", nil, []string{"memory"}),
-			"nonheap.used":          newMetrics("nonheap_used", "Non heap information in KB", nil, []string{"memory"}),
-			"threads":               newMetrics("threads", "Thread information", nil, []string{"thread"}),
-			"classes":               newMetrics("classes", "Class load information", nil, []string{"classes"}),
-			"classes.loaded":        newMetrics("classes_loaded", "Class load information", nil, []string{"classes"}),
-			"classes.unloaded":      newMetrics("classes_unloaded", "Class load information", nil, []string{"classes"}),
-			"gc.ps_scavenge.count":  newMetrics("gc_ps_scavenge_count", "Garbage collection information", nil, []string{"gc"}),
-			"gc.ps_scavenge.time":   newMetrics("gc_ps_scavenge_time", "Garbage collection information", nil, []string{"gc"}),
-			"gc.ps_marksweep.count": newMetrics("gc_ps_marksweep_count", "Garbage collection information", nil, []string{"gc"}),
-			"gc.ps_marksweep.time":  newMetrics("gc_ps_marksweep_time", "Garbage collection information", nil, []string{"gc"}),
-			"systemload.average":    newMetrics("systemload_average", "The average system load", nil, []string{"load_average"}),
-		},
-		client: &http.Client{
-			Transport: &http.Transport{
-				Dial: func(netw, addr string) (net.Conn, error) {
-					c, err := net.DialTimeout(netw, addr, timeout)
-					if err != nil {
-						return nil, err
-					}
-					if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
-						return nil, err
-					}
-					return c, nil
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "scrape_duration_seconds",
+			Help:        "How long the last scrape of Spring Actuator took",
+			ConstLabels: opts.ConstLabels,
+		}),
+		responseBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_scrape_response_bytes",
+			Help:        "Size of the uncompressed body of the metrics endpoint in the last scrape of Spring Actuator",
+			ConstLabels: opts.ConstLabels,
+		}),
+		totalBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_scrape_total_response_bytes",
+			Help:        "Size of the uncompressed bodies of every request of the last scrape of Spring Actuator",
+			ConstLabels: opts.ConstLabels,
+		}),
+		httpStatus: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_scrape_http_status",
+			Help:        "HTTP status of the metrics endpoint in the last scrape of Spring Actuator, 0 if there was no answer",
+			ConstLabels: opts.ConstLabels,
+		}),
+		lastAttempt: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_scrape_timestamp_seconds",
+			Help:        "Time the last scrape of Spring Actuator ended since unix epoch in seconds, 0 before the first one",
+			ConstLabels: opts.ConstLabels,
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_successful_scrape_timestamp_seconds",
+			Help:        "Time the last successful scrape of Spring Actuator ended since unix epoch in seconds, 0 before the first one",
+			ConstLabels: opts.ConstLabels,
+		}),
+		snapshotAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "target_snapshot_age_seconds",
+			Help:        "Age of the background scrape of Spring Actuator being served",
+			ConstLabels: opts.ConstLabels,
+		}),
+		scrapeErrors: scrapeErrors,
+		aborted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "scrapes_aborted_total",
+			Help:        "Scrapes of Spring Actuator abandoned because every caller waiting for them gave up",
+			ConstLabels: opts.ConstLabels,
+		}),
+		requestTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "endpoint_request_duration_seconds",
+			Help:        "Time until the response headers of the requests to each actuator endpoint, single meters counting as metric-detail",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"endpoint"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "endpoint_requests_total",
+			Help:        "Requests to each actuator endpoint by status class, error if there was no answer",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"endpoint", "status_class"}),
+		breaker: newCircuitBreaker(opts.CircuitBreakerFailures, opts.CircuitBreakerBackoff, opts.ConstLabels),
+		parseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "parse_errors_total",
+			Help:        "Values in valid Spring Actuator responses that weren't numbers and were skipped",
+			ConstLabels: opts.ConstLabels,
+		}),
+		sharedScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "shared_scrapes_total",
+			Help:        "Collections served from a scrape already in progress for another one",
+			ConstLabels: opts.ConstLabels,
+		}),
+		springMetrics:    springMetrics,
+		multipliers:      multipliers,
+		valuesReceived:   valuesReceived,
+		meterGroups:      newMeterGroups(opts),
+		versionInfo:      newVersionMetric(opts.ConstLabels),
+		certExpiry:       newCertExpiryMetric(opts.ConstLabels),
+		integrationGraph: newIntegrationGraphMetrics(opts),
+		beans:            newBeansMetrics(opts),
+		endpointUp:       newMetrics("endpoint_up", "Was the last fetch of each actuator endpoint of the target successful", opts.ConstLabels, []string{"endpoint"}),
+		notExposed:       newMetrics("endpoint_not_exposed", "Did the last fetch of each actuator endpoint of the target get a 404, e.g. because the endpoint isn't exposed", opts.ConstLabels, []string{"endpoint_name"}),
+		health:           newHealthMetrics(opts),
+		info:             newInfoMetrics(opts),
+		gcOverhead:       newGCOverhead(opts.ConstLabels),
+		configRefresh:    newConfigRefresh(opts.ConstLabels),
+		noCacheStatic:    opts.NoCacheStatic,
+		actuatorVersion:  opts.ActuatorVersion,
+		metricInclude:    opts.MetricInclude,
+		startTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "process_start_time_seconds",
+			Help:        "Start time of the JVM since unix epoch in seconds",
+			ConstLabels: opts.ConstLabels,
+		}),
+		client:             client,
+		ownsClient:         ownsClient,
+		attemptTimeout:     opts.Timeout,
+		totalTimeout:       opts.TotalTimeout,
+		scrapeInterval:     opts.ScrapeInterval,
+		scrapeJitter:       opts.ScrapeJitter,
+		snapshotMaxAge:     opts.SnapshotMaxAge,
+		minScrapeInterval:  opts.MinScrapeInterval,
+		history:            newScrapeHistory(opts.HistorySize),
+		linksTTL:           opts.EndpointLinksTTL,
+		renames:            opts.Renames,
+		tracePropagation:   opts.TracePropagation,
+		maxTagCombinations: opts.MaxTagCombinations,
+		meterParallelism:   opts.MeterParallelism,
+		changes:            newValueChanges(opts.ChangeThreshold),
+		errorLogs:          newErrorSampler(),
+		strictUp:           opts.StrictUp,
+	}
+	if opts.ValueHistogram {
+		e.values = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "metric_value_histogram",
+			Help:        "Distribution of the values received from Spring Actuator, by Spring Boot 1.x key or meter name",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     valueBuckets,
+		}, []string{"metric_name"})
+	}
+	if opts.AllMeters {
+		e.allMeters = newDiscoveredMeters()
+		e.meterGroups = append(e.meterGroups, e.allMeters.group)
+	}
+	if replay != nil {
+		replay.endpoint = e.recordEndpoint
+	}
+	return e
+}
+
+// actuatorProtocol selects the HTTP versions used to talk to Spring
+// Actuator.
+type actuatorProtocol int
+
+const (
+	// protocolHTTP1 only speaks HTTP/1.1.
+	protocolHTTP1 actuatorProtocol = iota
+	// protocolHTTP2 negotiates HTTP/2 over TLS and uses HTTP/1.1 in
+	// cleartext.
+	protocolHTTP2
+	// protocolH2C also speaks HTTP/2 in cleartext, with prior knowledge.
+	protocolH2C
+)
+
+// valueBuckets span the scales actuator values come in, from ratios to
+// byte counts, a power of ten apart.
+var valueBuckets = prometheus.ExponentialBuckets(1e-6, 10, 19)
+
+// metricGroups are the values of the metric_group label of
+// metric_values_received_total, with the prefixes of the Spring Boot 1.x
+// keys and meter names in each. Other names are "custom".
+var metricGroups = []struct {
+	group    string
+	prefixes []string
+}{
+	{"memory", []string{"mem", "heap.", "nonheap.", "jvm.memory.", "jvm.buffer."}},
+	{"gc", []string{"gc.", "jvm.gc."}},
+	{"threads", []string{"threads", "jvm.threads."}},
+	{"classes", []string{"classes", "jvm.classes."}},
+	{"system", []string{"systemload.", "system.", "process."}},
+}
+
+// metricGroup returns the metric_group of a Spring Boot 1.x key or meter.
+func metricGroup(name string) string {
+	for _, g := range metricGroups {
+		for _, p := range g.prefixes {
+			if strings.HasPrefix(name, p) {
+				return g.group
+			}
+		}
+	}
+	return "custom"
+}
+
+// receivedValue counts a value received for name and records it in the
+// value histogram, if it is enabled.
+func (e *Exporter) receivedValue(name string, v float64) {
+	e.valuesReceived.WithLabelValues(metricGroup(name)).Inc()
+	if e.values != nil {
+		e.values.WithLabelValues(name).Observe(v)
+	}
+}
+
+// checkRedirect applies the redirect policy of opts, logging the chain of
+// redirects at debug level.
+func checkRedirect(opts Options) func(*http.Request, []*http.Request) error {
+	max := opts.MaxRedirects
+	if max <= 0 {
+		max = 10
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		chain := make([]string, 0, len(via)+1)
+		for _, r := range via {
+			chain = append(chain, redactURL(r.URL.String()))
+		}
+		chain = append(chain, redactURL(req.URL.String()))
+		if opts.NoRedirects {
+			slog.DebugContext(req.Context(), "Not following redirect", "chain", chain)
+			return http.ErrUseLastResponse
+		}
+		if len(via) > max {
+			return fmt.Errorf("stopped after %d redirects", max)
+		}
+		slog.DebugContext(req.Context(), "Following redirect", "chain", chain)
+		return nil
+	}
+}
+
+// idleConnTimeout is how long a connection to an actuator is kept open
+// between scrapes. It is above the usual scrape intervals, so connections
+// are reused, but those to targets that went away are eventually closed.
+const idleConnTimeout = 2 * time.Minute
+
+// newHTTPClient returns the client used to talk to Spring Actuator, with
+// the timeouts, protocol and TLS renegotiation of opts. It can be shared
+// between exporters.
+func newHTTPClient(opts Options, tlsConfig *tls.Config) *http.Client {
+	timeout, protocol := opts.Timeout, opts.Protocol
+	// Requests are bounded by their context; these timeouts catch a stuck
+	// step early within it.
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if opts.UnixSocket != "" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", opts.UnixSocket)
+		}
+	}
+	headerTimeout := opts.ResponseHeaderTimeout
+	if headerTimeout <= 0 || (timeout > 0 && headerTimeout > timeout) {
+		headerTimeout = timeout
+	}
+	t := &http.Transport{
+		TLSClientConfig:       withRenegotiation(tlsConfig, opts.TLSRenegotiation),
+		DialContext:           dial,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: headerTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+	}
+	if protocol == protocolHTTP1 {
+		return &http.Client{Transport: t, CheckRedirect: checkRedirect(opts)}
+	}
+	if err := http2.ConfigureTransport(t); err != nil {
+		slog.Error("Can't enable HTTP/2 for Spring Actuator, using HTTP/1.1", "err", err)
+		return &http.Client{Transport: t, CheckRedirect: checkRedirect(opts)}
+	}
+	if protocol == protocolHTTP2 {
+		return &http.Client{Transport: t, CheckRedirect: checkRedirect(opts)}
+	}
+	return &http.Client{
+		CheckRedirect: checkRedirect(opts),
+		Transport: schemeTransport{
+			"https": t,
+			"http": &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, netw, addr string, _ *tls.Config) (net.Conn, error) {
+					return dial(ctx, netw, addr)
 				},
 			},
 		},
 	}
 }
 
-func (e *Exporter) scrape() {
-	resp, err := e.client.Get(e.URL)
-	if err != nil {
+// schemeTransport sends each request through the transport of its URL
+// scheme.
+type schemeTransport map[string]http.RoundTripper
+
+func (t schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt, ok := t[req.URL.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol scheme %q", req.URL.Scheme)
+	}
+	return rt.RoundTrip(req)
+}
+
+func (t schemeTransport) CloseIdleConnections() {
+	for _, rt := range t {
+		closeIdleConnections(rt)
+	}
+}
+
+// closeIdleConnections closes the idle connections of rt, if it keeps any.
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// Close stops the background scrapes of the exporter and closes the idle
+// connections of its client, unless the client is shared. The exporter
+// must not be used afterwards.
+func (e *Exporter) Close() {
+	e.stopBackground()
+	if e.ownsClient {
+		e.client.CloseIdleConnections()
+	}
+}
+
+// scrape fetches everything exported about the actuator, within the total
+// timeout. A scrape aborted because parent is done is only counted. Every
+// scrape gets an ID, logged with it and kept with its outcome.
+func (e *Exporter) scrape(parent context.Context) {
+	id := newScrapeID()
+	if !e.breaker.allow() {
 		e.up.Set(0)
-		log.Errorf("Can't scrape Spring Actuator: %v", err)
+		e.scrapeErrors.WithLabelValues("circuit_open").Inc()
+		e.recordScrape(time.Now(), id, errCircuitOpen)
+		return
+	}
+	ctx, cancel := context.WithCancel(parent)
+	if e.totalTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, e.totalTimeout)
+	}
+	ctx = withScrapeID(ctx, id)
+	if e.tracePropagation {
+		ctx = withTrace(ctx, e.URL)
+	}
+	e.ctx = ctx
+	defer func() {
+		cancel()
+		e.ctx = nil
+	}()
+
+	start := time.Now()
+	atomic.StoreInt64(&e.scrapeBytes, 0)
+	atomic.StoreInt64(&e.partialFailures, 0)
+	err := e.classify(e.scrapeEndpoints())
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	e.up.Set(up)
+	if err != nil && parent.Err() != nil {
+		slog.DebugContext(ctx, "Scrape aborted", "target", redactURL(e.URL), "err", parent.Err())
+		e.aborted.Inc()
+		e.changes.done(ctx, e.URL, err)
 		return
 	}
+	e.breaker.record(ctx, e.URL, err)
+	e.totalBytes.Set(float64(atomic.LoadInt64(&e.scrapeBytes)))
+	end := float64(time.Now().UnixNano()) / 1e9
+	e.lastAttempt.Set(end)
+	if err != nil {
+		reason := scrapeErrorReason(err)
+		e.errorLogs.log(ctx, "scrape "+reason, "Can't scrape Spring Actuator", "target", redactURL(e.URL), "reason", reason, "duration", time.Since(start), "err", redactError(err))
+		e.scrapeErrors.WithLabelValues(reason).Inc()
+		// The application may be restarting; look its start time up again.
+		e.startTimeKnown = false
+	} else {
+		e.lastSuccess.Set(end)
+		e.errorLogs.ok("scrape ")
+	}
+	e.duration.Set(time.Since(start).Seconds())
+	e.changes.done(ctx, e.URL, err)
+	e.recordScrape(start, id, err)
+	e.refreshVersion()
+}
+
+// classify decides whether a scrape failed, and with it up, given err from
+// the metrics endpoint. With strictUp a value or meter that failed within
+// a readable response fails the scrape too; otherwise it is left to the
+// failure counters and the target stays up.
+func (e *Exporter) classify(err error) error {
+	if n := atomic.LoadInt64(&e.partialFailures); err == nil && e.strictUp && n > 0 {
+		return fmt.Errorf("%d values or meters failed", n)
+	}
+	return err
+}
+
+// partialFailure records a value or meter that failed without failing the
+// scrape. A value that isn't a number is also a parse error.
+func (e *Exporter) partialFailure(parse bool) {
+	if parse {
+		e.parseErrors.Inc()
+	}
+	atomic.AddInt64(&e.partialFailures, 1)
+}
+
+// statusError is an unexpected HTTP status of the actuator.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("StatusCode: %d", int(e))
+}
+
+// readError is a failure to read a response body.
+type readError struct {
+	err error
+}
+
+func (e readError) Error() string {
+	return "reading response body failed: " + e.err.Error()
+}
+
+func (e readError) Unwrap() error {
+	return e.err
+}
+
+// scrapeErrorReasons are the values of the reason label of
+// scrape_errors_total.
+var scrapeErrorReasons = []string{"circuit_open", "deadline", "resolve", "connect", "tls", "timeout", "http_4xx", "http_5xx", "read", "parse"}
+
+// scrapeErrorReason tells which step of a scrape failed, for
+// scrape_errors_total. Errors that aren't about the network or the HTTP
+// exchange come from an unusable response, so they are "parse".
+// "circuit_open" and "deadline" are counted where a target isn't scraped.
+func scrapeErrorReason(err error) string {
+	var (
+		dnsErr    *net.DNSError
+		opErr     *net.OpError
+		netErr    net.Error
+		status    statusError
+		readErr   readError
+		authority x509.UnknownAuthorityError
+		invalid   x509.CertificateInvalidError
+		hostname  x509.HostnameError
+		header    tls.RecordHeaderError
+		verifyErr *tls.CertificateVerificationError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return "resolve"
+	case errors.As(err, &authority), errors.As(err, &invalid), errors.As(err, &hostname), errors.As(err, &header), errors.As(err, &verifyErr):
+		return "tls"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &readErr):
+		return "read"
+	case errors.As(err, &opErr):
+		return "connect"
+	case errors.Is(err, errNotFound):
+		return "http_4xx"
+	case errors.As(err, &status) && status >= 500:
+		return "http_5xx"
+	case errors.As(err, &status):
+		return "http_4xx"
+	default:
+		return "parse"
+	}
+}
+
+// maxAttempts bounds how often a failing request to the actuator is tried.
+const maxAttempts = 3
+
+// cancelOnClose releases the context of a request when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// countingBody adds the bytes read from a response body to n, atomically.
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// get fetches u, retrying connection errors and 5xx answers up to
+// maxAttempts times. Each attempt is bounded by the per-attempt timeout and
+// all of them by the total timeout of the scrape in progress.
+func (e *Exporter) get(u string) (*http.Response, error) {
+	return e.getAttempts(u, maxAttempts)
+}
+
+// observeRequest records the latency and outcome of a request to u.
+func (e *Exporter) observeRequest(u string, start time.Time, resp *http.Response, err error) {
+	endpoint := e.endpointOf(u)
+	e.requestTime.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	class := "error"
+	if err == nil {
+		class = fmt.Sprintf("%dxx", resp.StatusCode/100)
+	}
+	e.requests.WithLabelValues(endpoint, class).Inc()
+}
+
+// endpointOf names the actuator endpoint of u for the request metrics. The
+// requests for single meters all count as metric-detail, so there is no
+// label value per meter.
+func (e *Exporter) endpointOf(u string) string {
+	switch {
+	case u == e.URL:
+		return "metrics"
+	case strings.HasPrefix(u, strings.TrimSuffix(e.URL, "/")+"/"):
+		return "metric-detail"
+	case u == e.endpointURL(""):
+		return "root"
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "other"
+	}
+	return path.Base(parsed.Path)
+}
+
+// getAttempts is get with another bound on the number of attempts.
+func (e *Exporter) getAttempts(u string, attempts int) (*http.Response, error) {
+	parent := e.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		ctx, cancel := context.WithCancel(parent)
+		if e.attemptTimeout > 0 {
+			ctx, cancel = context.WithTimeout(parent, e.attemptTimeout)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		injectTrace(req)
+		start := time.Now()
+		resp, err := e.client.Do(req)
+		e.observeRequest(u, start, resp, err)
+		if err == nil && (resp.StatusCode < 500 || attempt == attempts) {
+			resp.Body = cancelOnClose{countingBody{resp.Body, &e.scrapeBytes}, cancel}
+			if recorder != nil {
+				resp.Body = &recordingBody{ReadCloser: resp.Body, start: start, target: targetLabel(u), endpoint: e.recordEndpoint(u)}
+			}
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = statusError(resp.StatusCode)
+		}
+		lastErr = err
+		attemptExpired := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		switch {
+		case parent.Err() == context.DeadlineExceeded:
+			if attemptExpired {
+				slog.WarnContext(parent, "Fetch hit the total timeout, along with the per-attempt timeout", "url", redactURL(u), "attempt", attempt, "timeout", e.totalTimeout, "attempt_timeout", e.attemptTimeout)
+			} else {
+				slog.WarnContext(parent, "Fetch hit the total timeout", "url", redactURL(u), "attempt", attempt, "timeout", e.totalTimeout)
+			}
+			return nil, lastErr
+		case parent.Err() != nil:
+			return nil, lastErr
+		case attemptExpired:
+			slog.WarnContext(parent, "Fetch attempt hit the per-attempt timeout", "url", redactURL(u), "attempt", attempt, "attempts", attempts, "attempt_timeout", e.attemptTimeout)
+		default:
+			slog.DebugContext(parent, "Fetch attempt failed", "url", redactURL(u), "attempt", attempt, "attempts", attempts, "err", redactError(err))
+		}
+		if attempt < attempts {
+			select {
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			case <-parent.Done():
+				return nil, lastErr
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+func (e *Exporter) scrapeMetrics() error {
+	resp, err := e.get(e.URL)
+	if err != nil {
+		e.httpStatus.Set(0)
+		e.responseBytes.Set(0)
+		return err
+	}
 	defer resp.Body.Close()
+	e.httpStatus.Set(float64(resp.StatusCode))
+	if resp.TLS != nil {
+		if expiry, cn, ok := certExpiry(resp.TLS); ok {
+			e.certExpiry.WithLabelValues(cn).Set(float64(expiry.Unix()))
+		}
+	}
 
 	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-		e.up.Set(0)
-		log.Errorf("Can't scrape Spring Actuator: StatusCode: %d", resp.StatusCode)
-		return
+		e.responseBytes.Set(0)
+		return statusError(resp.StatusCode)
+	}
+	if resp.Header.Get("X-Application-Context") != "" {
+		atomic.StoreInt32(&e.appContextSeen, 1)
+	}
+	// The body is decoded as it is read, keeping only its start for error
+	// messages. Numbers are kept as json.Number until they are exported.
+	var n int64
+	sample := &prefixBuffer{limit: bodySampleSize + 1}
+	dec := json.NewDecoder(io.TeeReader(countingBody{resp.Body, &n}, sample))
+	dec.UseNumber()
+	var metrics map[string]interface{}
+	err = dec.Decode(&metrics)
+	e.responseBytes.Set(float64(n))
+	if err != nil {
+		// An error page from the application or a proxy fails this
+		// target only.
+		if isJSONError(err) {
+			return fmt.Errorf("JSON decoding failed: %v; body starts with %q", err, bodySample(sample.buf))
+		}
+		return readError{err}
+	}
+	atomic.StoreInt32(&e.hasSucceededOnce, 1)
+	if e.actuatorVersion != "2" {
+		e.export(metrics)
+		e.gcOverhead.gatherBoot1(metrics)
+	}
+
+	// Spring Boot 2.x answers /actuator/metrics with an index of meter names.
+	if raw, ok := metrics["names"]; ok && raw != nil && e.actuatorVersion != "1" {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return fmt.Errorf("invalid meter name list: %T", raw)
+		}
+		names := make([]string, 0, len(list))
+		for _, n := range list {
+			name, ok := n.(string)
+			if !ok {
+				return fmt.Errorf("invalid meter name %v", n)
+			}
+			names = append(names, name)
+		}
+		e.scrapeMeters(names)
+	}
+	return nil
+}
+
+// checkReachable fetches the metrics endpoint once, within timeout, and
+// reports whether it answered with a 2xx status.
+func (e *Exporter) checkReachable(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		return statusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// bodySampleSize bounds how much of an unusable response body is logged.
+const bodySampleSize = 200
+
+// prefixBuffer keeps the first limit bytes written to it.
+type prefixBuffer struct {
+	buf   []byte
+	limit int
+}
+
+func (p *prefixBuffer) Write(b []byte) (int, error) {
+	if room := p.limit - len(p.buf); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		p.buf = append(p.buf, b[:room]...)
+	}
+	return len(b), nil
+}
+
+// isJSONError reports whether err comes from the content of a JSON
+// document rather than from reading it.
+func isJSONError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return err == io.EOF || err == io.ErrUnexpectedEOF || errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// numberValue returns v as a float64 if it is a JSON number, in any
+// notation, or a string holding one such as "42".
+func numberValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		return numericString(v)
+	}
+	return 0, false
+}
+
+// numericString parses a number sent as a JSON string. "NaN" and the
+// infinities are refused, as a JSON number can't hold them either.
+func numericString(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// bodySample returns the start of body, for error messages.
+func bodySample(body []byte) string {
+	if len(body) > bodySampleSize {
+		return string(body[:bodySampleSize]) + "..."
+	}
+	return string(body)
+}
+
+var errNotFound = errors.New("not found")
+
+// fetchJSON decodes the JSON document at u into v. A 404 is reported as
+// errNotFound.
+func (e *Exporter) fetchJSON(u string, v interface{}) error {
+	resp, err := e.get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Application-Context") != "" {
+		atomic.StoreInt32(&e.appContextSeen, 1)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		return statusError(resp.StatusCode)
 	}
-	e.up.Set(1)
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Errorf("Reading response body failed %v", err)
-		return
+		return readError{err}
 	}
+	return json.Unmarshal(body, v)
+}
 
-	var metrics map[string]*json.RawMessage
-	if err := json.Unmarshal(body, &metrics); err != nil {
-		log.Fatalf("JSON unmarshaling failed: %s", err)
+// endpointURL returns the URL of the actuator endpoint name: the link the
+// actuator root gives for it or else a sibling of the metrics endpoint
+// being scraped. An empty name gives the actuator root.
+func (e *Exporter) endpointURL(name string) string {
+	if href, ok := e.links[name]; ok && name != "" {
+		return href
 	}
-	e.export(metrics)
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return ""
+	}
+	u.Path = path.Join(path.Dir(strings.TrimSuffix(u.Path, "/")), name)
+	u.RawQuery = ""
+	return u.String()
 }
 
-func (e *Exporter) export(metrics map[string]*json.RawMessage) {
+// export sets the Spring Boot 1.x metrics from the /metrics map. Values
+// that aren't numbers are skipped and counted in parse_errors_total.
+func (e *Exporter) export(metrics map[string]interface{}) {
 	for k, v := range metrics {
-		_, ok := e.springMetrics[k]
+		_, known := e.springMetrics[k]
+		if !known || !e.included(k) {
+			if _, ok := numberValue(v); ok && !known {
+				logOnce(e.logContext(), slog.LevelDebug, "unknown "+e.URL+" "+k, "Skipping unknown key", "target", redactURL(e.URL), "metric", k)
+			}
+			continue
+		}
+		value, ok := numberValue(v)
 		if !ok {
+			logOnce(e.logContext(), slog.LevelDebug, "nan "+e.URL+" "+k, "Skipping value: not a number", "target", redactURL(e.URL), "metric", k)
+			e.partialFailure(true)
 			continue
 		}
-		switch k {
-		case "systemload.average":
-			var tmp float64
-			json.Unmarshal(*v, &tmp)
-			e.springMetrics[k].WithLabelValues(k).Set(tmp)
-		default:
-			var tmp uint64
-			json.Unmarshal(*v, &tmp)
-			e.springMetrics[k].WithLabelValues(k).Set(float64(tmp))
+		if m, ok := e.multipliers[k]; ok {
+			value *= m
 		}
+		e.receivedValue(k, value)
+		e.changes.observe(k, value)
+		e.springMetrics[k].WithLabelValues(k).Set(value)
 	}
 }
 
+// included reports whether the metric key or meter name passes the
+// target's include patterns.
+func (e *Exporter) included(name string) bool {
+	return matchesAny(e.metricInclude, name)
+}
+
+// Describe sends the descriptors of the metrics of the exporter. With
+// AllMeters they aren't known in advance, so nothing is sent and the
+// exporter is an unchecked collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	if e.allMeters != nil {
+		return
+	}
 	ch <- e.up.Desc()
+	ch <- e.duration.Desc()
+	ch <- e.responseBytes.Desc()
+	ch <- e.totalBytes.Desc()
+	ch <- e.httpStatus.Desc()
+	e.certExpiry.Describe(ch)
+	ch <- e.lastAttempt.Desc()
+	ch <- e.lastSuccess.Desc()
+	ch <- e.snapshotAge.Desc()
+	e.scrapeErrors.Describe(ch)
+	if e.breaker != nil {
+		ch <- e.breaker.state.Desc()
+	}
+	ch <- e.parseErrors.Desc()
+	e.valuesReceived.Describe(ch)
+	e.requestTime.Describe(ch)
+	e.requests.Describe(ch)
+	ch <- e.sharedScrapes.Desc()
+	ch <- e.aborted.Desc()
+	ch <- e.startTime.Desc()
+	e.versionInfo.Describe(ch)
 	for _, m := range e.springMetrics {
 		m.Describe(ch)
 	}
+	for _, m := range e.meterVecs() {
+		m.Describe(ch)
+	}
+	for _, m := range e.meterCounters() {
+		m.Describe(ch)
+	}
+	e.integrationGraph.components.Describe(ch)
+	e.endpointUp.Describe(ch)
+	e.notExposed.Describe(ch)
+	if e.values != nil {
+		e.values.Describe(ch)
+	}
+	e.health.status.Describe(ch)
+	e.info.info.Describe(ch)
+	ch <- e.gcOverhead.ratio.Desc()
+	ch <- e.configRefresh.last.Desc()
+	ch <- e.integrationGraph.lastRefresh.Desc()
+	ch <- e.beans.total.Desc()
+	e.beans.byScope.Describe(ch)
 }
 
+// Collect scrapes the actuator, or serves the last background scrape if
+// the exporter scrapes in the background, or the last successful scrape if
+// it is more recent than the minimum scrape interval.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collectContext(context.Background(), ch, false)
+}
+
+// collectContext is Collect for a caller that gives up once ctx is done.
+// With refresh, the actuator is scraped whatever the minimum scrape
+// interval.
+func (e *Exporter) collectContext(ctx context.Context, ch chan<- prometheus.Metric, refresh bool) {
+	var metrics []prometheus.Metric
+	if bg := e.background(); bg != nil {
+		e.collectBackground(ch, bg)
+	} else if cached, ok := e.cachedMetrics(); ok && !refresh {
+		metrics = cached
+	} else {
+		metrics = e.collectShared(ctx)
+	}
+	for _, m := range metrics {
+		ch <- m
+	}
+	ch <- e.sharedScrapes
+	ch <- e.aborted
+}
+
+// requestCollector collects an exporter for an HTTP request: the scrape is
+// abandoned if the client goes away, and refresh bypasses the minimum
+// scrape interval.
+type requestCollector struct {
+	*Exporter
+	ctx     context.Context
+	refresh bool
+}
+
+func (c requestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collectContext(c.ctx, ch, c.refresh)
+}
+
+// cachedMetrics returns the metrics of the last successful scrape if it is
+// more recent than the minimum scrape interval.
+func (e *Exporter) cachedMetrics() ([]prometheus.Metric, bool) {
+	if e.minScrapeInterval <= 0 {
+		return nil, false
+	}
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
+	if e.cached == nil || time.Since(e.cachedAt) >= e.minScrapeInterval {
+		return nil, false
+	}
+	return e.cached, true
+}
+
+// scrapeFlight is a scrape in progress, whose result concurrent Collects
+// share.
+type scrapeFlight struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+	// waiters is how many callers wait for the scrape. cancel aborts it
+	// when the last one gives up.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// collectShared scrapes the actuator, or, if a scrape is already in
+// progress, waits for it and returns its result. The scrape is bounded by
+// the exporter's own timeouts, not by any caller's deadline, so callers
+// with a later deadline are never cut short by one with an earlier one.
+// Once every caller has given up, though, the scrape is aborted. A caller
+// whose ctx is done gets nil.
+func (e *Exporter) collectShared(ctx context.Context) []prometheus.Metric {
+	e.flightMu.Lock()
+	f := e.flight
+	shared := f != nil
+	if !shared {
+		flightCtx, cancel := context.WithCancel(context.Background())
+		f = &scrapeFlight{done: make(chan struct{}), cancel: cancel}
+		e.flight = f
+		go e.runFlight(flightCtx, f)
+	}
+	f.waiters++
+	e.flightMu.Unlock()
+
+	select {
+	case <-f.done:
+		if shared {
+			e.sharedScrapes.Inc()
+		}
+		return f.metrics
+	case <-ctx.Done():
+		e.flightMu.Lock()
+		defer e.flightMu.Unlock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+			// Later callers start a scrape of their own.
+			if e.flight == f {
+				e.flight = nil
+			}
+		}
+		return nil
+	}
+}
+
+func (e *Exporter) runFlight(ctx context.Context, f *scrapeFlight) {
+	start := time.Now()
+	f.metrics = gatherMetrics(func(ch chan<- prometheus.Metric) {
+		e.collect(ctx, ch)
+	})
+	if e.minScrapeInterval > 0 && ctx.Err() == nil && e.Status().Up {
+		e.cacheMu.Lock()
+		e.cached, e.cachedAt = f.metrics, start
+		e.cacheMu.Unlock()
+	}
+	e.flightMu.Lock()
+	if e.flight == f {
+		e.flight = nil
+	}
+	e.flightMu.Unlock()
+	f.cancel()
+	close(f.done)
+}
+
+// collect scrapes the actuator, unless ctx is done first, and sends the
+// results.
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	ch, recorded := e.recordHistory(ch)
+	defer recorded()
+	e.collectMu.Lock()
+	defer e.collectMu.Unlock()
 	e.resetMetrics()
-	e.scrape()
-	ch <- e.up
+	e.scrape(ctx)
+	// up and the timestamps are copied so that they agree with each other
+	// in every exposition of this scrape, whatever later scrapes do.
+	ch <- frozen(e.up)
+	ch <- e.duration
+	ch <- e.responseBytes
+	ch <- e.totalBytes
+	ch <- e.httpStatus
+	e.certExpiry.Collect(ch)
+	ch <- frozen(e.lastAttempt)
+	ch <- frozen(e.lastSuccess)
+	e.scrapeErrors.Collect(ch)
+	if e.breaker != nil {
+		ch <- e.breaker.state
+	}
+	ch <- e.parseErrors
+	e.valuesReceived.Collect(ch)
+	e.requestTime.Collect(ch)
+	e.requests.Collect(ch)
+	e.versionInfo.Reset()
+	e.versionInfo.WithLabelValues(e.version.boot, e.version.framework).Set(1)
+	e.versionInfo.Collect(ch)
+	if e.startTimeKnown {
+		ch <- e.startTime
+	}
 	for _, m := range e.springMetrics {
 		m.Collect(ch)
 	}
+	for _, m := range e.meterVecs() {
+		m.Collect(ch)
+	}
+	for _, m := range e.meterCounters() {
+		m.Collect(ch)
+	}
+	e.integrationGraph.collect(ch)
+	e.beans.collect(ch)
+	e.endpointUp.Collect(ch)
+	e.notExposed.Collect(ch)
+	if e.values != nil {
+		e.values.Collect(ch)
+	}
+	e.health.status.Collect(ch)
+	e.info.info.Collect(ch)
+	if e.configRefresh.known {
+		ch <- e.configRefresh.last
+	}
+	// Derived metrics, computed once everything has been gathered.
+	e.gcOverhead.update()
+	ch <- e.gcOverhead.ratio
+}
+
+// frozen returns the current value of g as a metric that later changes to
+// g don't affect.
+func frozen(g prometheus.Gauge) prometheus.Metric {
+	var pb dto.Metric
+	if err := g.Write(&pb); err != nil {
+		return prometheus.NewInvalidMetric(g.Desc(), err)
+	}
+	return prometheus.MustNewConstMetric(g.Desc(), prometheus.GaugeValue, pb.GetGauge().GetValue())
+}
+
+// deadlineExceeded reports the target down, in place of its metrics, when
+// it couldn't be scraped before the deadline of the scrape of the exporter.
+func (e *Exporter) deadlineExceeded(ch chan<- prometheus.Metric) {
+	e.scrapeErrors.WithLabelValues("deadline").Inc()
+	ch <- prometheus.MustNewConstMetric(e.up.Desc(), prometheus.GaugeValue, 0)
+	ch <- frozen(e.lastAttempt)
+	ch <- frozen(e.lastSuccess)
+	e.scrapeErrors.Collect(ch)
 }
 
 func (e *Exporter) resetMetrics() {
 	for _, m := range e.springMetrics {
 		m.Reset()
 	}
+	for _, m := range e.meterVecs() {
+		m.Reset()
+	}
+	e.integrationGraph.components.Reset()
+	e.beans.reset()
+	e.endpointUp.Reset()
+	e.notExposed.Reset()
+	e.certExpiry.Reset()
+	e.health.status.Reset()
+	e.info.info.Reset()
+	e.gcOverhead.reset()
+}
+
+// padLabels returns labels with an empty value added for each of names it
+// lacks.
+func padLabels(labels prometheus.Labels, names []string) prometheus.Labels {
+	if len(names) == 0 {
+		return labels
+	}
+	padded := make(prometheus.Labels, len(labels)+len(names))
+	for _, n := range names {
+		padded[n] = ""
+	}
+	for k, v := range labels {
+		padded[k] = v
+	}
+	return padded
 }
 
 func newMetrics(name string, help string, constLabels prometheus.Labels, labels []string) *prometheus.GaugeVec {
@@ -147,25 +1471,655 @@ func newMetrics(name string, help string, constLabels prometheus.Labels, labels
 }
 
 func main() {
+	startTime := time.Now()
 	var (
-		listenAddress     = flag.String("web.listen-address", ":9101", "Address to listen on for web interface and telemetry.")
-		metricsPath       = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		actuatorScrapeURI = flag.String("actuator.scrape-uri", "http://localhost/metrics", "URI on which to scrape Spring Actuator.")
-		timeout           = flag.Duration("actuator.timeout", 5*time.Second, "Timeout for trying to get stats from Spring Actuator.")
+		listenAddress        = flag.String("web.listen-address", ":9101", "Address to listen on for web interface and telemetry.")
+		secureListenAddress  = flag.String("web.secure-listen-address", "", "Address to serve the telemetry endpoints on over TLS only. The main listener then serves only the landing page and /healthz.")
+		logLevel             = flag.String("log.level", "info", "Only log messages with the given severity or above: debug, info, warn or error.")
+		logRepeated          = flag.Bool("log.repeated", false, "Log repeated messages, such as the skipped keys of a target, every time instead of once.")
+		errorSampling        = flag.Duration("log.error-sampling-interval", 5*time.Minute, "Log an error that keeps happening on a target, such as an endpoint that is down, at most once per interval after the first, with how long it has been going on. 0 logs every occurrence.")
+		logFormat            = flag.String("log.format", "logfmt", "Output format of log messages: logfmt or json.")
+		metricsPath          = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		pageTitle            = flag.String("web.page-title", "Spring Actuator Exporter", "Title of the landing page.")
+		pageDescription      = flag.String("web.page-description", "Prometheus exporter for Spring Boot Actuator metrics", "Description shown on the landing page.")
+		startupPath          = flag.String("web.startup-path", "/startup", "Path of the startup probe, which succeeds once every target has been scraped successfully.")
+		dnsSRVNames          = flag.String("discovery.dns-srv-names", "", "Comma-separated DNS SRV record names, e.g. _actuator._tcp.orders.service.consul, whose targets are scraped too.")
+		dnsInterval          = flag.Duration("discovery.dns-interval", 30*time.Second, "Interval between resolutions of -discovery.dns-srv-names.")
+		dnsScheme            = flag.String("discovery.dns-scheme", "http", "Scheme used to scrape targets found in DNS.")
+		dnsPath              = flag.String("discovery.dns-path", "/actuator/metrics", "Path of the metrics endpoint on targets found in DNS.")
+		eurekaURL            = flag.String("discovery.eureka-url", "", "Base URL of the Eureka server REST API, e.g. http://eureka:8761/eureka, to discover targets from.")
+		eurekaApps           = flag.String("discovery.eureka-apps", "", "Comma-separated glob patterns of the (lowercase) Eureka app names to scrape. Empty scrapes all apps.")
+		eurekaInterval       = flag.Duration("discovery.eureka-interval", 30*time.Second, "Interval between polls of the Eureka registry.")
+		eurekaUsername       = flag.String("discovery.eureka-username", "", "Username for basic authentication to Eureka.")
+		eurekaPasswordFile   = flag.String("discovery.eureka-password-file", "", "File holding the password for basic authentication to Eureka.")
+		eurekaPath           = flag.String("discovery.eureka-path", "/actuator/metrics", "Metrics endpoint path of Eureka instances whose metadata doesn't tell.")
+		consulServer         = flag.String("discovery.consul-server", "", "Address of the Consul HTTP API, e.g. http://localhost:8500, to discover targets from.")
+		consulTags           = flag.String("discovery.consul-tags", "spring-actuator", "Comma-separated tags a Consul service must carry to be scraped.")
+		consulPortMeta       = flag.String("discovery.consul-port-meta", "management_port", "Service metadata key holding the management port. The service port is used when it is missing.")
+		consulScheme         = flag.String("discovery.consul-scheme", "http", "Scheme used to scrape targets found in Consul.")
+		consulPath           = flag.String("discovery.consul-path", "/actuator/metrics", "Template of the metrics endpoint path of targets found in Consul, e.g. {{.Meta.context_path}}/metrics.")
+		consulDatacenter     = flag.String("discovery.consul-datacenter", "", "Consul datacenter to query. Empty uses the agent's.")
+		consulTokenFile      = flag.String("discovery.consul-token-file", "", "File holding the Consul ACL token.")
+		consulOnlyPassing    = flag.Bool("discovery.consul-only-passing", false, "Skip Consul instances failing a health check.")
+		consulInterval       = flag.Duration("discovery.consul-interval", 30*time.Second, "Interval between polls of the Consul catalog.")
+		k8sEnable            = flag.Bool("discovery.kubernetes", false, "Discover targets from Kubernetes pods annotated with spring-actuator/scrape=true.")
+		k8sKubeconfig        = flag.String("discovery.kubernetes-kubeconfig", "", "kubeconfig file to use instead of the in-cluster configuration.")
+		k8sNamespaces        = flag.String("discovery.kubernetes-namespaces", "", "Comma-separated namespaces to watch. Empty watches all namespaces.")
+		k8sAppLabel          = flag.String("discovery.kubernetes-app-label", "app", "Pod label whose value is exported as the app label.")
+		k8sPath              = flag.String("discovery.kubernetes-path", "/actuator/metrics", "Metrics endpoint path of pods without a spring-actuator/path annotation.")
+		k8sResync            = flag.Duration("discovery.kubernetes-resync", 5*time.Minute, "Resync period of the pod informers.")
+		discoveryGrace       = flag.Duration("discovery.grace-period", 5*time.Minute, "How long a target that is no longer discovered keeps being scraped.")
+		maxConcurrentTargets = flag.Int("actuator.max-concurrent-targets", 4, "Maximum number of targets of each target set (static, or from one discovery mechanism) scraped at the same time.")
+		scrapeTimeoutOffset  = flag.Duration("web.scrape-timeout-offset", 500*time.Millisecond, "Time subtracted from the Prometheus scrape timeout to get the deadline of a /metrics scrape. Targets not scraped by then are reported down.")
+		probeTargets         = flag.String("probe.allowed-targets", "", "Comma-separated host or host:port patterns /probe may scrape. Empty allows any target.")
+		probeMaxTimeout      = flag.Duration("probe.max-timeout", 30*time.Second, "Maximum timeout a /probe request may ask for with the timeout parameter. 0 means no limit.")
+		probeTimeoutOffset   = flag.Duration("probe.timeout-offset", 500*time.Millisecond, "Time subtracted from the Prometheus scrape timeout to bound /probe timeouts.")
+		timeout              = flag.Duration("actuator.timeout", 5*time.Second, "Deprecated: use -actuator.timeout-per-attempt.")
+		attemptTimeout       = flag.Duration("actuator.timeout-per-attempt", 5*time.Second, "Timeout of each HTTP request to Spring Actuator.")
+		totalTimeout         = flag.Duration("actuator.timeout-total", 15*time.Second, "Timeout of a whole scrape of a target, retries included.")
+		readTimeout          = flag.Duration("web.read-timeout", 10*time.Second, "Maximum duration for reading an entire request, including the body.")
+		writeTimeout         = flag.Duration("web.write-timeout", 30*time.Second, "Maximum duration before timing out writes of the response. Should be well above -actuator.timeout-total.")
+		idleTimeout          = flag.Duration("web.idle-timeout", 60*time.Second, "Maximum amount of time to wait for the next request when keep-alives are enabled.")
+		maxHeaderBytes       = flag.Int("web.max-header-bytes", 16<<10, "Maximum number of bytes the server will read parsing the request headers.")
+		shutdownTimeout      = flag.Duration("web.shutdown-timeout", 10*time.Second, "Time allowed for in-flight requests to complete on shutdown.")
+		gcCollectorList      = flag.String("actuator.gc-collectors", strings.Join(defaultGCCollectors, ","), "Comma-separated garbage collectors whose Spring Boot 1.x gc.<name>.count and gc.<name>.time keys are exported as gc_<name>_count and gc_<name>_time.")
+		unixSocket           = flag.String("actuator.unix-socket", "", "Connect to Spring Actuator through this Unix domain socket instead of TCP. The scrape URIs keep their path; use a host such as localhost, which is sent as the Host header.")
+		inputPath            = flag.String("actuator.input-file", "", "Read the responses of the targets from this file, served as the metrics endpoint, or directory with a file per endpoint, instead of sending requests. For reproducing issues from saved payloads.")
+		dnsRefresh           = flag.Duration("actuator.dns-refresh-interval", 0, "Close the idle connections to the targets this often, so that their host names are looked up again. 0 keeps connections until they have been idle for 2 minutes.")
+		upMode               = flag.String("actuator.up-mode", "lenient", "What makes spring_actuator_up 0: lenient when the metrics endpoint fails or can't be parsed, strict also when a value isn't a number or a Spring Boot 2.x meter can't be fetched.")
+		allowRedirects       = flag.Bool("actuator.allow-redirects", true, "Follow redirects from Spring Actuator, up to -actuator.max-redirects. When false a 3xx answer fails the request.")
+		maxRedirects         = flag.Int("actuator.max-redirects", 3, "Maximum number of redirects in a row followed for a request to Spring Actuator.")
+		headerTimeout        = flag.Duration("actuator.response-header-timeout", 3*time.Second, "Give up on a request to Spring Actuator if the response headers haven't arrived after this long. Reading the body is bounded by -actuator.timeout-per-attempt only. Should be below it, which otherwise bounds the headers too.")
+		tlsRenegotiation     = flag.String("actuator.tls-renegotiation", "none", "TLS renegotiation accepted from Spring Actuator servers: none, once or freely. Only for legacy servers that require it.")
+		actuatorHTTP2        = flag.Bool("actuator.http2", false, "Use HTTP/2 to talk to Spring Actuator over TLS.")
+		actuatorH2C          = flag.Bool("actuator.http2-cleartext", false, "With -actuator.http2, also use HTTP/2 (h2c, with prior knowledge) for http:// targets.")
+		enableH2C            = flag.Bool("web.enable-h2c", false, "Accept cleartext HTTP/2 (h2c) connections.")
+		snapshotInterval     = flag.Duration("web.snapshot-interval", 0, "Gather all metrics in the background at this interval and serve the latest snapshot on /metrics. 0 scrapes on every request. Can't be used with -actuator.scrape-interval.")
+		scrapeInterval       = flag.Duration("actuator.scrape-interval", 0, "Scrape every target in the background at this interval, on its own timer, and serve its latest results on /metrics. 0 scrapes on every request. Can't be used with -web.snapshot-interval.")
+		minScrapeInterval    = flag.Duration("actuator.min-scrape-interval", 0, "Serve the last successful scrape of a target again, instead of scraping it, until it is this old. 0 scrapes on every request.")
+		snapshotMaxAge       = flag.Duration("actuator.snapshot-max-age", 0, "With -actuator.scrape-interval, report a target down instead of serving its last background scrape once that is older than this. 0 serves it whatever its age.")
+		scrapeJitter         = flag.Duration("actuator.scrape-jitter", 0, "With -actuator.scrape-interval, delay the first background scrape of each target by up to this much, so targets aren't all scraped at once.")
+		disableCompression   = flag.Bool("web.disable-exposition-compression", false, "Never gzip the metrics exposition, even if the client accepts it.")
+		corsOrigin           = flag.String("web.cors-origin", "", "Deprecated: use -web.cors-origins.")
+		corsOrigins          = flag.String("web.cors-origins", "", "Comma-separated origins allowed to fetch the read-only endpoints from a browser, or '*' for any. Empty disables CORS.")
+		allowedCIDRs         = flag.String("web.allowed-cidrs", "", "Comma-separated list of CIDRs allowed to access the exporter. Empty allows everyone.")
+		trustProxyHeaders    = flag.Bool("web.trust-proxy-headers", false, "Use X-Forwarded-For to find the client address when the peer is a trusted proxy.")
+		trustedProxies       = flag.String("web.trusted-proxies", "", "Comma-separated list of CIDRs of proxies trusted with -web.trust-proxy-headers.")
+		tlsCertFile          = flag.String("web.tls-cert-file", "", "Path to the certificate file for serving over TLS.")
+		tlsKeyFile           = flag.String("web.tls-key-file", "", "Path to the key file for serving over TLS.")
+		tlsClientCA          = flag.String("web.tls-client-ca", "", "Path to the CA bundle used to verify client certificates.")
+		tlsClientAuth        = flag.String("web.tls-client-auth", "none", "Client certificate policy: none, request or require-and-verify.")
+		textfileDir          = flag.String("textfile.output-dir", "", "Directory to periodically write metrics to for the node_exporter textfile collector.")
+		textfileInterval     = flag.Duration("textfile.write-interval", 15*time.Second, "Interval between writes to -textfile.output-dir.")
+		otlpEndpoint         = flag.String("otlp.endpoint", "", "host:port of an OTLP gRPC receiver to push metrics to. Empty disables OTLP.")
+		otlpHeaders          = flag.String("otlp.headers", "", "Comma-separated key=value headers sent with every OTLP export, e.g. for authentication.")
+		otlpInterval         = flag.Duration("otlp.interval", 30*time.Second, "Interval between OTLP pushes.")
+		otlpTimeout          = flag.Duration("otlp.timeout", 10*time.Second, "Timeout of each OTLP export.")
+		otlpInsecure         = flag.Bool("otlp.insecure", false, "Connect to -otlp.endpoint without TLS.")
+		selfContainedDemo    = flag.Bool("self-contained-demo", false, "Scrape two simulated Spring Boot applications (1.x and 2.x) served by the exporter itself, for demos and tutorials.")
+		demoInterval         = flag.Duration("demo.update-interval", 5*time.Second, "Interval between updates of the simulated metrics of -self-contained-demo.")
+		pidFilePath          = flag.String("pid-file", "", "Write the process ID to this file and remove it on shutdown.")
+		foreground           = flag.Bool("foreground", true, "Stay in the foreground. Set to false to detach from the terminal; logs still go to stderr.")
+		renameFile           = flag.String("actuator.metric-rename-file", "", "YAML file of {from, to} rules renaming exported metrics. Reloaded when it changes.")
+		targetsFile          = flag.String("actuator.targets-file", "", "YAML file listing the targets to scrape, with per-target credentials, TLS settings and labels. Replaces -actuator.scrape-uri.")
+		probeAtStartup       = flag.Bool("actuator.probe-at-startup", false, "Check that every static target is reachable at startup. Unreachable targets are only logged.")
+		startupProbeTimeout  = flag.Duration("actuator.startup-probe-timeout", 3*time.Second, "Timeout of the -actuator.probe-at-startup check of each target.")
+		endpointLinksTTL     = flag.Duration("actuator.endpoint-links-ttl", 10*time.Minute, "How long the endpoint links listed at the actuator root are cached. 0 derives endpoint URLs from the metrics URL only.")
+		enableBeans          = flag.Bool("actuator.enable-beans", false, "Count the Spring beans of the beans endpoint, in total and by scope. The endpoint can be large.")
+		allDiscovered        = flag.Bool("actuator.enable-all-discovered", false, "Export every meter listed by Spring Boot 2.x actuators, not only the known ones.")
+		maxSeries            = flag.Int("actuator.max-series", 200000, "Maximum number of series of a /metrics exposition. Series beyond it are left out and spring_actuator_series_limit_exceeded is set. 0 means no limit.")
+		meterParallelism     = flag.Int("actuator.meter-scrape-parallelism", 10, "Maximum number of Spring Boot 2.x meters of a target fetched at a time.")
+		maxTagCombinations   = flag.Int("actuator.max-tag-combinations", 100, "Maximum number of tag combinations of a meter fetched in a scrape, each taking a request. 0 means no limit.")
+		breakerFailures      = flag.Int("actuator.circuit-breaker-failures", 0, "After this many failed scrapes in a row, only try a target again every -actuator.circuit-breaker-backoff, reporting it down in between. 0 disables the circuit breaker.")
+		breakerBackoff       = flag.Duration("actuator.circuit-breaker-backoff", time.Minute, "How long a target whose circuit breaker opened is left alone before it is tried again.")
+		changeThreshold      = flag.Float64("actuator.log-change-threshold", 50, "Log at debug level the values that changed by more than this percentage since the last successful scrape. 0 disables it.")
+		valueHistogram       = flag.Bool("actuator.value-histogram", false, "Export the distribution of the values received from Spring Actuator as spring_actuator_metric_value_histogram, by metric, to spot metrics changing scale.")
+		tracePropagation     = flag.Bool("actuator.trace-propagation", false, "Send a W3C traceparent header with every request to Spring Actuator, one trace per scrape, and log the trace IDs at debug level.")
+		historySize          = flag.Int("actuator.scrape-history-size", 0, "Number of scrapes of each target kept for /history. 0 disables the history.")
+		recordDir            = flag.String("debug.record-dir", "", "Directory to write the raw response body of every request to Spring Actuator to, for debugging. Headers are never written.")
+		recordMaxFiles       = flag.Int("debug.record-max-files", 1000, "Maximum number of responses kept in -debug.record-dir; the oldest are removed first. 0 means no limit.")
+		recordMaxBytes       = flag.Int64("debug.record-max-bytes", 100<<20, "Maximum total size in bytes of the responses kept in -debug.record-dir; the oldest are removed first. 0 means no limit.")
+		noCacheStatic        = flag.Bool("actuator.no-cache-static", false, "Fetch static meters such as process.start.time on every scrape instead of once.")
+		enableMongoDB        featureFlag
+		enableRedis          featureFlag
+		enableIntegration    featureFlag
+		enableTomcatSessions featureFlag
+		enableConfigClient   featureFlag
+		enableHealth         featureFlag
+		enableInfo           featureFlag
+		actuatorScrapeURIs   = uriList{uris: []string{"http://localhost/metrics"}}
 	)
+	flag.Var(&actuatorScrapeURIs, "actuator.scrape-uri", "URI on which to scrape Spring Actuator. Repeat or separate with commas to scrape several targets, labeled by host:port. Empty serves only exporter metrics on /metrics, for use with /probe.")
+	flag.Var(&actuatorScrapeURIs, "actuator.scrape-uris", "Comma-separated URIs on which to scrape Spring Actuator. Same as -actuator.scrape-uri.")
+	flag.Var(&enableMongoDB, "actuator.enable-mongodb", "Export MongoDB driver command metrics (true, false or auto to detect).")
+	flag.Var(&enableIntegration, "actuator.enable-integration-graph", "Count Spring Integration components from the integrationgraph endpoint (true, false or auto to detect).")
+	flag.Var(&enableTomcatSessions, "actuator.enable-tomcat-sessions", "Export Tomcat session management metrics (true, false or auto to detect).")
+	flag.Var(&enableConfigClient, "actuator.enable-config-client", "Export Spring Cloud Config client metrics (true, false or auto to detect).")
+	flag.Var(&enableHealth, "actuator.enable-health", "Export the status of the health endpoint (true, false or auto to detect).")
+	flag.Var(&enableInfo, "actuator.enable-info", "Export the application details of the info endpoint (true, false or auto to detect).")
+	flag.Var(&enableRedis, "actuator.enable-redis", "Export Redis client command and connection metrics (true, false or auto to detect).")
 	flag.Parse()
-	exporter := NewExporter(*actuatorScrapeURI, *timeout)
-	prometheus.MustRegister(exporter)
-	log.Infof("Starting Server: %s", *listenAddress)
-	http.Handle(*metricsPath, prometheus.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-		<head><title>Spring Actuator Exporter</title></head>
-		<body>
-		<h1>Spring Actuator Exporter</h1>
-		<p><a href='` + *metricsPath + `'>Metrics</a></p>
-		</body>
-		</html>`))
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	repeatedLogs.disabled = *logRepeated
+	errorSamplingInterval = *errorSampling
+	if *recordDir != "" {
+		if recorder, err = newResponseRecorder(*recordDir, *recordMaxFiles, *recordMaxBytes); err != nil {
+			fatal("Can't record responses", "dir", *recordDir, "err", err)
+		}
+		slog.Warn("Recording the responses of the targets, which may hold sensitive data", "dir", *recordDir)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "actuator.timeout":
+			slog.Warn("-actuator.timeout is deprecated, use -actuator.timeout-per-attempt")
+			*attemptTimeout = *timeout
+		case "web.cors-origin":
+			slog.Warn("-web.cors-origin is deprecated, use -web.cors-origins")
+		}
+	})
+	if *writeTimeout < *totalTimeout+writeTimeoutSlack {
+		slog.Warn("-web.write-timeout leaves too little time over -actuator.timeout-total; slow scrapes may produce truncated responses", "write_timeout", *writeTimeout, "timeout_total", *totalTimeout, "min_slack", writeTimeoutSlack)
+	}
+	if *headerTimeout > 0 && *attemptTimeout > 0 && *headerTimeout >= *attemptTimeout {
+		slog.Warn("-actuator.response-header-timeout is not below -actuator.timeout-per-attempt, which bounds the wait for headers instead", "response_header_timeout", *headerTimeout, "timeout_per_attempt", *attemptTimeout)
+	}
+	if *snapshotInterval > 0 && *scrapeInterval > 0 {
+		fatal("-web.snapshot-interval and -actuator.scrape-interval can't be used together")
+	}
+	if *snapshotMaxAge > 0 && *scrapeInterval == 0 {
+		slog.Warn("-actuator.snapshot-max-age has no effect without -actuator.scrape-interval")
+	}
+	if *scrapeJitter > 0 && *scrapeInterval == 0 {
+		slog.Warn("-actuator.scrape-jitter has no effect without -actuator.scrape-interval")
+	}
+	if !*foreground {
+		parent, err := daemonize()
+		if err != nil {
+			fatal("Can't start in the background", "err", err)
+		}
+		if parent {
+			return
+		}
+	}
+	if *pidFilePath != "" {
+		if err := writePIDFile(*pidFilePath); err != nil {
+			fatal("Can't write PID file", "err", err)
+		}
+		defer removePIDFile()
+	}
+	gcCollectors, err := parseGCCollectors(*gcCollectorList)
+	if err != nil {
+		fatal("Invalid -actuator.gc-collectors", "err", err)
+	}
+	renegotiation, ok := renegotiationModes[*tlsRenegotiation]
+	if !ok {
+		fatal("Invalid -actuator.tls-renegotiation, must be none, once or freely", "value", *tlsRenegotiation)
+	}
+	if *upMode != "lenient" && *upMode != "strict" {
+		fatal("Invalid -actuator.up-mode, must be lenient or strict", "value", *upMode)
+	}
+	protocol := protocolHTTP1
+	switch {
+	case *actuatorHTTP2 && *actuatorH2C:
+		protocol = protocolH2C
+	case *actuatorHTTP2:
+		protocol = protocolHTTP2
+	case *actuatorH2C:
+		slog.Warn("-actuator.http2-cleartext has no effect without -actuator.http2")
+	}
+	opts := Options{
+		Timeout:                *attemptTimeout,
+		TotalTimeout:           *totalTimeout,
+		ScrapeInterval:         *scrapeInterval,
+		MinScrapeInterval:      *minScrapeInterval,
+		SnapshotMaxAge:         *snapshotMaxAge,
+		ScrapeJitter:           *scrapeJitter,
+		Protocol:               protocol,
+		TLSRenegotiation:       renegotiation,
+		ResponseHeaderTimeout:  *headerTimeout,
+		InputPath:              *inputPath,
+		StrictUp:               *upMode == "strict",
+		NoRedirects:            !*allowRedirects,
+		MaxRedirects:           *maxRedirects,
+		UnixSocket:             *unixSocket,
+		GCCollectors:           gcCollectors,
+		NoCacheStatic:          *noCacheStatic,
+		HistorySize:            *historySize,
+		AllMeters:              *allDiscovered,
+		MaxTagCombinations:     *maxTagCombinations,
+		MeterParallelism:       *meterParallelism,
+		TracePropagation:       *tracePropagation,
+		ValueHistogram:         *valueHistogram,
+		ChangeThreshold:        *changeThreshold,
+		CircuitBreakerFailures: *breakerFailures,
+		CircuitBreakerBackoff:  *breakerBackoff,
+		EndpointLinksTTL:       *endpointLinksTTL,
+		MeterGroups: map[string]featureFlag{
+			"mongodb":         enableMongoDB,
+			"redis":           enableRedis,
+			"tomcat-sessions": enableTomcatSessions,
+			"config-client":   enableConfigClient,
+		},
+		IntegrationGraph: enableIntegration,
+		Beans:            *enableBeans,
+		Endpoints: map[string]featureFlag{
+			"health": enableHealth,
+			"info":   enableInfo,
+		},
+	}
+	opts.Client = newHTTPClient(opts, nil)
+	if *inputPath != "" {
+		if _, err := os.Stat(*inputPath); err != nil {
+			fatal("Can't read -actuator.input-file", "err", err)
+		}
+		slog.Info("Replaying responses instead of scraping the targets", "input", *inputPath)
+	}
+	probeAllowlist, err := parseTargetAllowlist(*probeTargets)
+	if err != nil {
+		fatal("Invalid -probe.allowed-targets", "err", err)
+	}
+	if *renameFile != "" {
+		if opts.Renames, err = loadRenameRules(*renameFile); err != nil {
+			fatal("Can't load rename file", "err", err)
+		}
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	if *selfContainedDemo {
+		if actuatorScrapeURIs.set || *targetsFile != "" {
+			fatal("-self-contained-demo can't be combined with -actuator.scrape-uri(s) or -actuator.targets-file")
+		}
+		actuatorScrapeURIs.uris = startDemo(ctx, *demoInterval)
+		slog.Info("Serving demo actuators", "targets", strings.Join(actuatorScrapeURIs.uris, ","))
+	}
+
+	// Discovered targets are scraped alongside the static ones. Every
+	// target carries the labels of every mechanism, so the label names are
+	// known up front.
+	var (
+		discoveries     []*discoveryManager
+		discoveryLabels []string
+	)
+	if *dnsSRVNames != "" {
+		var names []string
+		for _, n := range strings.Split(*dnsSRVNames, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, n)
+			}
+		}
+		discoveries = append(discoveries, newDiscoveryManager("DNS SRV", dnsSRVDiscovery(names, *dnsScheme, *dnsPath), opts, *dnsInterval, *discoveryGrace, *maxConcurrentTargets))
+		discoveryLabels = append(discoveryLabels, "instance")
+	}
+	if *eurekaURL != "" {
+		var apps []string
+		for _, a := range strings.Split(*eurekaApps, ",") {
+			if a = strings.ToLower(strings.TrimSpace(a)); a == "" {
+				continue
+			}
+			if _, err := path.Match(a, ""); err != nil {
+				fatal("Invalid -discovery.eureka-apps pattern", "pattern", a, "err", err)
+			}
+			apps = append(apps, a)
+		}
+		var password string
+		if *eurekaPasswordFile != "" {
+			b, err := ioutil.ReadFile(*eurekaPasswordFile)
+			if err != nil {
+				fatal("Can't read -discovery.eureka-password-file", "err", err)
+			}
+			password = strings.TrimSpace(string(b))
+			knownSecrets.addBasicAuth(*eurekaUsername, password)
+		}
+		client := &http.Client{Timeout: *attemptTimeout}
+		discoveries = append(discoveries, newDiscoveryManager("Eureka", eurekaDiscovery(client, *eurekaURL, apps, *eurekaUsername, password, *eurekaPath), opts, *eurekaInterval, *discoveryGrace, *maxConcurrentTargets))
+		discoveryLabels = append(discoveryLabels, "app", "instance_id")
+	}
+	if *consulServer != "" {
+		c := &consulConfig{
+			server:      *consulServer,
+			datacenter:  *consulDatacenter,
+			portMeta:    *consulPortMeta,
+			scheme:      *consulScheme,
+			onlyPassing: *consulOnlyPassing,
+		}
+		for _, t := range strings.Split(*consulTags, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				c.tags = append(c.tags, t)
+			}
+		}
+		if c.path, err = template.New("path").Option("missingkey=zero").Parse(*consulPath); err != nil {
+			fatal("Invalid -discovery.consul-path", "err", err)
+		}
+		if *consulTokenFile != "" {
+			b, err := ioutil.ReadFile(*consulTokenFile)
+			if err != nil {
+				fatal("Can't read -discovery.consul-token-file", "err", err)
+			}
+			c.token = strings.TrimSpace(string(b))
+			knownSecrets.add(c.token)
+		}
+		client := &http.Client{Timeout: *attemptTimeout}
+		discoveries = append(discoveries, newDiscoveryManager("Consul", consulDiscovery(client, c), opts, *consulInterval, *discoveryGrace, *maxConcurrentTargets))
+		discoveryLabels = append(discoveryLabels, "service", "node")
+	}
+	if *k8sEnable {
+		client, err := newKubernetesClient(*k8sKubeconfig)
+		if err != nil {
+			fatal("Can't create Kubernetes client", "err", err)
+		}
+		var namespaces []string
+		for _, ns := range strings.Split(*k8sNamespaces, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				namespaces = append(namespaces, ns)
+			}
+		}
+		// Pods are known to be gone as soon as the informer says so, hence
+		// no grace period.
+		var kd *kubernetesDiscovery
+		m := newDiscoveryManager("Kubernetes", func(ctx context.Context) ([]discoveredTarget, error) {
+			return kd.discover(ctx)
+		}, opts, *k8sResync, 0, *maxConcurrentTargets)
+		if kd, err = newKubernetesDiscovery(ctx, client, namespaces, *k8sResync, *k8sAppLabel, *k8sPath, m.notify); err != nil {
+			fatal("Can't start Kubernetes discovery", "err", err)
+		}
+		discoveries = append(discoveries, m)
+		discoveryLabels = append(discoveryLabels, "namespace", "pod", "app")
+	}
+	if len(discoveries) > 0 {
+		discoveryLabels = append(discoveryLabels, "target")
+		opts.LabelNames = mergeLabelNames(nil, discoveryLabels...)
+	}
+
+	// The static targets are rebuilt when the rename rules change, since
+	// metric names are fixed when an exporter is created, and when the
+	// targets file changes.
+	var (
+		targets    liveTargets
+		targetsCfg atomic.Value
+		rebuildMu  sync.Mutex
+	)
+	// storeTargets makes ts the static targets and brings the discovered
+	// targets in line with its label names. renamed rebuilds the discovered
+	// targets even if those are unchanged.
+	storeTargets := func(ts *targetSet, renamed bool) {
+		if ts != nil {
+			targets.Store(ts)
+		}
+		o := opts
+		if ts != nil {
+			o.LabelNames = mergeLabelNames(ts.labelNames, discoveryLabels...)
+		}
+		for _, d := range discoveries {
+			d.setOptions(o, renamed)
+		}
+	}
+	if *targetsFile != "" {
+		if actuatorScrapeURIs.set {
+			fatal("-actuator.targets-file and -actuator.scrape-uri(s) can't be used together")
+		}
+		cfg, err := loadTargetsConfig(*targetsFile)
+		if err != nil {
+			fatal("Invalid -actuator.targets-file", "err", redactError(err))
+		}
+		targetsCfg.Store(cfg)
+	}
+	newTargets := func(reuse bool) (*targetSet, error) {
+		if cfg, ok := targetsCfg.Load().(*targetsConfig); ok {
+			var prev *targetSet
+			if reuse {
+				prev = targets.Load()
+			}
+			return newConfiguredTargetSet(cfg, opts, *maxConcurrentTargets, prev)
+		}
+		return newTargetSet(actuatorScrapeURIs.uris, opts, *maxConcurrentTargets)
+	}
+	if *targetsFile != "" || len(actuatorScrapeURIs.uris) > 0 {
+		ts, err := newTargets(false)
+		if err != nil {
+			fatal("Invalid targets", "err", redactError(err))
+		}
+		storeTargets(ts, false)
+		for _, e := range ts.exporters {
+			if *probeAtStartup {
+				if err := e.checkReachable(*startupProbeTimeout); err != nil {
+					slog.Warn("Spring Actuator is not reachable", "target", redactURL(e.URL), "err", redactError(err))
+					continue
+				}
+			}
+			v := e.Version()
+			slog.Info("Detected Spring versions", "target", redactURL(e.URL), "spring_boot", v.boot, "spring_framework", v.framework)
+		}
+	}
+
+	if opts.Renames != nil {
+		go opts.Renames.watch(ctx, func() {
+			rebuildMu.Lock()
+			defer rebuildMu.Unlock()
+			if targets.Load() == nil {
+				storeTargets(nil, true)
+				return
+			}
+			ts, err := newTargets(false)
+			if err != nil {
+				slog.Error("Can't rebuild targets with new rename rules", "err", err)
+				return
+			}
+			storeTargets(ts, true)
+		})
+	}
+	// The targets live in a registry of their own so that /metrics can
+	// collect them with the deadline of each scrape.
+	allTargets := &targetsCollector{sets: []*liveTargets{&targets}}
+	for _, d := range discoveries {
+		allTargets.sets = append(allTargets.sets, &d.targets)
+		go d.run(ctx)
+	}
+	targetsRegistry := prometheus.NewRegistry()
+	targetsRegistry.MustRegister(allTargets)
+	defer allTargets.stopBackground()
+	if *dnsRefresh > 0 {
+		go refreshConnections(ctx, *dnsRefresh, opts.Client, allTargets)
+	}
+	prometheus.MustRegister(newFleetCollector(allTargets, discoveries))
+	go dumpStateOnSignal(ctx, allTargets)
+	allGatherer := prometheus.Gatherers{prometheus.DefaultGatherer, targetsRegistry}
+	var reloader *targetsReloader
+	if *targetsFile != "" {
+		reloader = newTargetsReloader(*targetsFile, func(cfg *targetsConfig) error {
+			rebuildMu.Lock()
+			defer rebuildMu.Unlock()
+			old := targetsCfg.Load()
+			targetsCfg.Store(cfg)
+			ts, err := newTargets(true)
+			if err != nil {
+				targetsCfg.Store(old)
+				return err
+			}
+			storeTargets(ts, false)
+			return nil
+		})
+		prometheus.MustRegister(reloader.success, reloader.successTime)
+		go reloader.watch(ctx)
+	}
+	if *otlpEndpoint != "" {
+		headers, err := parseHeaders(*otlpHeaders)
+		if err != nil {
+			fatal("Invalid -otlp.headers", "err", err)
+		}
+		pusher, err := newOTLPPusher(ctx, allGatherer, *otlpEndpoint, headers, *otlpTimeout, *otlpInsecure)
+		if err != nil {
+			fatal("Can't set up OTLP export", "err", err)
+		}
+		go pusher.run(ctx, *otlpInterval)
+	}
+	if *textfileDir != "" {
+		go runTextfileWriter(ctx, allGatherer, *textfileDir, *textfileInterval)
+	}
+	if *listenAddress == "" && (*textfileDir != "" || *otlpEndpoint != "") {
+		slog.Info("Running without the HTTP server")
+		<-ctx.Done()
+		return
+	}
+
+	// With -web.secure-listen-address the telemetry endpoints move to their
+	// own TLS-only server and the main listener keeps the landing page and
+	// health check in plain HTTP.
+	mux := http.NewServeMux()
+	metricsMux := mux
+	if *secureListenAddress != "" {
+		if *tlsCertFile == "" {
+			fatal("-web.secure-listen-address requires -web.tls-cert-file and -web.tls-key-file")
+		}
+		metricsMux = http.NewServeMux()
+	}
+	compressor := newExpositionCompressor(*disableCompression)
+	prometheus.MustRegister(compressor.bytes)
+	var gatherer prometheus.Gatherer = allGatherer
+	if *snapshotInterval > 0 {
+		snapshots := newSnapshotGatherer(allGatherer)
+		go snapshots.run(ctx, *snapshotInterval)
+		gatherer = snapshots
+	}
+	series := &seriesCounter{}
+	var limit *seriesLimit
+	if *maxSeries > 0 {
+		limit = newSeriesLimit(*maxSeries)
+	}
+	metricsHandler := compressor.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g := gatherer
+		// Without snapshots, targets are scraped now, must be done before
+		// Prometheus gives up on the scrape and are abandoned if it
+		// disconnects.
+		if *snapshotInterval == 0 {
+			timeout, _ := scrapeTimeout(r, *scrapeTimeoutOffset)
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(allTargets.within(r.Context(), timeout))
+			g = prometheus.Gatherers{prometheus.DefaultGatherer, reg}
+		}
+		if limit != nil {
+			g = limit.wrap(g)
+		}
+		promhttp.HandlerFor(series.wrap(g), promhttp.HandlerOpts{
+			// Compression is done by compressor so it can be measured.
+			DisableCompression: true,
+		}).ServeHTTP(w, r)
+	}))
+	origins := append(parseOrigins(*corsOrigins), parseOrigins(*corsOrigin)...)
+	metricsMux.Handle(*metricsPath, corsHandler(origins, metricsHandler))
+	metricsMux.Handle("/dump", corsHandler(origins, dumpHandler(gatherer)))
+	metricsMux.Handle("/probe", probeHandler(opts, probeAllowlist, *probeMaxTimeout, *probeTimeoutOffset, func() *targetsConfig {
+		cfg, _ := targetsCfg.Load().(*targetsConfig)
+		return cfg
+	}))
+	metricsMux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		cfg, ok := targetsCfg.Load().(*targetsConfig)
+		if !ok {
+			http.Error(w, "No -actuator.targets-file loaded", http.StatusNotFound)
+			return
+		}
+		// Secrets are redacted when marshaled, and passwords of target
+		// URLs here.
+		b, err := yaml.Marshal(cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(redact(string(b))))
 	})
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	metricsMux.Handle("/targets", targetsHandler(allTargets))
+	if *historySize > 0 {
+		metricsMux.Handle("/history", historyHandler(allTargets))
+	}
+	if reloader != nil {
+		metricsMux.Handle("/-/reload", reloader)
+	}
+	mux.Handle("/healthz", healthHandler(startTime, allTargets.Statuses, series))
+	mux.Handle(*startupPath, startupHandler(func() []*Exporter {
+		if ts := targets.Load(); ts != nil {
+			return ts.exporters
+		}
+		return nil
+	}))
+	mux.Handle("/", landingHandler(*pageTitle, *pageDescription, *metricsPath))
+
+	var wrap func(http.Handler) http.Handler
+	if *allowedCIDRs != "" {
+		allowed, err := parseCIDRs(*allowedCIDRs)
+		if err != nil {
+			fatal("Invalid -web.allowed-cidrs", "err", err)
+		}
+		var proxies []*net.IPNet
+		if *trustProxyHeaders {
+			if proxies, err = parseCIDRs(*trustedProxies); err != nil {
+				fatal("Invalid -web.trusted-proxies", "err", err)
+			}
+			if len(proxies) == 0 {
+				fatal("-web.trust-proxy-headers requires -web.trusted-proxies")
+			}
+		}
+		allowlist := newIPAllowlist(allowed, proxies)
+		prometheus.MustRegister(allowlist.denied)
+		wrap = allowlist.wrap
+	}
+	newServer := func(addr string, handler http.Handler) *http.Server {
+		if wrap != nil {
+			handler = wrap(handler)
+		}
+		return &http.Server{
+			Addr:           addr,
+			Handler:        handler,
+			ReadTimeout:    *readTimeout,
+			WriteTimeout:   *writeTimeout,
+			IdleTimeout:    *idleTimeout,
+			MaxHeaderBytes: *maxHeaderBytes,
+			ErrorLog:       newServerErrorLog(),
+		}
+	}
+	server := newServer(*listenAddress, mux)
+	servers := []*http.Server{server}
+	tlsServer := server
+	if *secureListenAddress != "" {
+		tlsServer = newServer(*secureListenAddress, metricsMux)
+		servers = append(servers, tlsServer)
+	}
+
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		if *tlsCertFile == "" || *tlsKeyFile == "" {
+			fatal("-web.tls-cert-file and -web.tls-key-file must be set together")
+		}
+		certs, err := newCertReloader(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			fatal("Can't load TLS certificate", "err", err)
+		}
+		go certs.reloadOnSIGHUP(ctx)
+		tlsConfig, err := newTLSConfig(certs, *tlsClientCA, *tlsClientAuth)
+		if err != nil {
+			fatal("Invalid TLS configuration", "err", err)
+		}
+		tlsServer.TLSConfig = tlsConfig
+	} else if *tlsClientCA != "" || *tlsClientAuth != "none" {
+		fatal("-web.tls-client-ca and -web.tls-client-auth require -web.tls-cert-file and -web.tls-key-file")
+	}
+	if *enableH2C {
+		for _, srv := range servers {
+			if srv.TLSConfig != nil {
+				continue
+			}
+			if err := configureH2C(srv); err != nil {
+				fatal("Can't enable h2c", "err", err)
+			}
+		}
+	}
+	for _, srv := range servers {
+		slog.Info("Starting server", "address", srv.Addr, "tls", srv.TLSConfig != nil)
+	}
+	if err := serveAll(ctx, servers, *shutdownTimeout); err != nil {
+		fatal("Server failed", "err", err)
+	}
 }
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrapeErrorReason(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&url.Error{Op: "Get", URL: "http://app/metrics", Err: &net.DNSError{Err: "no such host", Name: "app", IsNotFound: true}}, "resolve"},
+		{&url.Error{Op: "Get", URL: "http://app/metrics", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, "connect"},
+		{context.DeadlineExceeded, "timeout"},
+		{&url.Error{Op: "Get", URL: "http://app/metrics", Err: context.DeadlineExceeded}, "timeout"},
+		{&url.Error{Op: "Get", URL: "https://app/metrics", Err: x509.UnknownAuthorityError{}}, "tls"},
+		{&url.Error{Op: "Get", URL: "https://app/metrics", Err: x509.HostnameError{Host: "app", Certificate: &x509.Certificate{}}}, "tls"},
+		{statusError(503), "http_5xx"},
+		{statusError(401), "http_4xx"},
+		{errNotFound, "http_4xx"},
+		{fmt.Errorf("fetching meters: %w", errNotFound), "http_4xx"},
+		{readError{errors.New("unexpected EOF")}, "read"},
+		{errors.New(`JSON decoding failed: invalid character '<'`), "parse"},
+	} {
+		if got := scrapeErrorReason(tc.err); got != tc.want {
+			t.Errorf("scrapeErrorReason(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestScrapeErrorReasonsAreKnown(t *testing.T) {
+	known := make(map[string]bool, len(scrapeErrorReasons))
+	for _, r := range scrapeErrorReasons {
+		known[r] = true
+	}
+	for _, err := range []error{context.DeadlineExceeded, statusError(500), statusError(404), readError{errors.New("x")}, errors.New("x"), &net.DNSError{}, &net.OpError{Err: errors.New("x")}, x509.UnknownAuthorityError{}} {
+		if r := scrapeErrorReason(err); !known[r] {
+			t.Errorf("scrapeErrorReason(%v) = %q, not in scrapeErrorReasons", err, r)
+		}
+	}
+}
+
+// The response header timeout fails a target whose headers are late, but
+// not one that sends them at once and then streams its body slowly.
+func TestResponseHeaderTimeout(t *testing.T) {
+	slowHeaders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte(`{"mem": 1}`))
+	}))
+	defer slowHeaders.Close()
+	slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mem": `))
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte(`1}`))
+	}))
+	defer slowBody.Close()
+
+	opts := Options{Timeout: 2 * time.Second, ResponseHeaderTimeout: 100 * time.Millisecond}
+	e := NewExporter(slowHeaders.URL+"/metrics", opts)
+	gather(t, e)
+	if st := e.Status(); st.Up {
+		t.Error("target with late headers is up")
+	} else if n := testutil.ToFloat64(e.scrapeErrors.WithLabelValues("timeout")); n != 1 {
+		t.Errorf("target with late headers failed with %q, want a timeout", st.Error)
+	}
+	e = NewExporter(slowBody.URL+"/metrics", opts)
+	gather(t, e)
+	if st := e.Status(); !st.Up {
+		t.Errorf("target with a slow body is down: %s", st.Error)
+	}
+}
+
+// The scrape duration is exported for successful and failed scrapes alike.
+func TestScrapeDuration(t *testing.T) {
+	ok := memServer(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	for _, url := range []string{ok.URL + "/metrics", failing.URL + "/metrics"} {
+		mfs := gather(t, NewExporter(url, Options{Timeout: time.Second}))
+		if v, found := findMetric(mfs, "spring_actuator_scrape_duration_seconds", nil); !found || v <= 0 {
+			t.Errorf("%s: scrape_duration_seconds = %v (found %v), want > 0", url, v, found)
+		}
+	}
+}
+
+// The timeout covers reading the body: a target that stalls after sending
+// part of it fails at the configured timeout instead of holding the scrape.
+func TestTimeoutCoversBody(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mem": `))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	e := NewExporter(ts.URL+"/metrics", Options{Timeout: 100 * time.Millisecond, TotalTimeout: 250 * time.Millisecond})
+	start := time.Now()
+	gather(t, e)
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("scrape of a stalled body took %v, want about 250ms", took)
+	}
+	if st := e.Status(); st.Up {
+		t.Error("target with a stalled body is up")
+	} else if n := testutil.ToFloat64(e.scrapeErrors.WithLabelValues("timeout")); n != 1 {
+		t.Errorf("target with a stalled body failed with %q, want a timeout", st.Error)
+	}
+}
+
+// Concurrent scrapes of one target each get a whole exposition. Run with
+// -race.
+func TestConcurrentCollect(t *testing.T) {
+	ts := memServer(t)
+	e := NewExporter(ts.URL+"/metrics", Options{Timeout: time.Second})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				reg := prometheus.NewRegistry()
+				reg.MustRegister(e)
+				mfs, err := reg.Gather()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if v, _ := findMetric(mfs, "spring_actuator_up", nil); v != 1 {
+					t.Errorf("up = %v in a concurrent scrape", v)
+				}
+				if v, ok := findMetric(mfs, "spring_actuator_mem", nil); !ok || v != 1 {
+					t.Errorf("mem = %v (found %v) in a concurrent scrape", v, ok)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// A target answering with an HTML page is reported down, and up again once
+// it sends JSON.
+func TestUnparsableBody(t *testing.T) {
+	var mu sync.Mutex
+	body := `<html><body><h1>502 Bad Gateway</h1></body></html>`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	e := NewExporter(ts.URL+"/metrics", Options{Timeout: time.Second})
+	if v, _ := findMetric(gather(t, e), "spring_actuator_up", nil); v != 0 {
+		t.Errorf("up = %v with an HTML body, want 0", v)
+	}
+	if n := testutil.ToFloat64(e.scrapeErrors.WithLabelValues("parse")); n != 1 {
+		t.Errorf("%v parse errors counted, want 1", n)
+	}
+
+	mu.Lock()
+	body = `{"mem": 1}`
+	mu.Unlock()
+	mfs := gather(t, e)
+	if v, _ := findMetric(mfs, "spring_actuator_up", nil); v != 1 {
+		t.Errorf("up = %v after the target recovered, want 1", v)
+	}
+	if v, ok := findMetric(mfs, "spring_actuator_mem", nil); !ok || v != 1 {
+		t.Errorf("mem = %v (found %v) after the target recovered, want 1", v, ok)
+	}
+}
+
+// Cancelling the context of a request, or of the scrape it belongs to,
+// abandons it at once, well before the timeouts of the transport.
+func TestRequestCancellation(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	opts := Options{Timeout: 5 * time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	resp, err := newHTTPClient(opts, nil).Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request to a hanging target succeeded")
+	}
+	if took := time.Since(start); !errors.Is(err, context.DeadlineExceeded) || took > time.Second {
+		t.Errorf("cancelled request failed after %v with %v", took, err)
+	}
+
+	set, err := newTargetSet([]string{ts.URL + "/metrics"}, opts, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets liveTargets
+	targets.Store(set)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	gather(t, (&targetsCollector{sets: []*liveTargets{&targets}}).within(ctx, 0))
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("cancelled scrape took %v", took)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets")
+	}
+	sock := filepath.Join(t.TempDir(), "actuator.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "localhost" {
+			t.Errorf("request for host %q, want localhost", r.Host)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mem": 1}`))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	e := NewExporter("http://localhost/metrics", Options{Timeout: time.Second, UnixSocket: sock})
+	mfs := gather(t, e)
+	if v, _ := findMetric(mfs, "spring_actuator_up", nil); v != 1 {
+		t.Fatalf("target on a unix socket is down: %s", e.Status().Error)
+	}
+	if v, ok := findMetric(mfs, "spring_actuator_mem", nil); !ok || v != 1 {
+		t.Errorf("mem = %v (found %v), want 1", v, ok)
+	}
+}
+
+// Repeated scrapes reuse their connections instead of piling new ones up,
+// and closing the exporter closes them.
+func TestConnectionsBounded(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		open, max int
+	)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mem": 1}`))
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+			if open > max {
+				max = open
+			}
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	e := NewExporter(ts.URL+"/metrics", Options{Timeout: time.Second})
+	for i := 0; i < 50; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				gather(t, e)
+			}()
+		}
+		wg.Wait()
+	}
+	mu.Lock()
+	if max > 8 {
+		t.Errorf("%d connections open at once over 150 scrapes", max)
+	}
+	mu.Unlock()
+
+	e.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := open
+		mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still open after Close", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEndpointNotExposed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/actuator/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "UP"}`))
+	}))
+	defer ts.Close()
+
+	mfs := gather(t, NewExporter(ts.URL+"/actuator/metrics", Options{Timeout: time.Second}))
+	for endpoint, want := range map[string]float64{"metrics": 1, "health": 0} {
+		v, ok := findMetric(mfs, "spring_actuator_endpoint_not_exposed", map[string]string{"endpoint_name": endpoint})
+		if !ok || v != want {
+			t.Errorf("endpoint_not_exposed{endpoint_name=%q} = %v (found %v), want %v", endpoint, v, ok, want)
+		}
+	}
+	if v, _ := findMetric(mfs, "spring_actuator_up", nil); v != 0 {
+		t.Errorf("up = %v without a metrics endpoint, want 0", v)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics":
+			http.Redirect(w, r, "/metrics/", http.StatusFound)
+		case "/twice":
+			http.Redirect(w, r, "/metrics", http.StatusFound)
+		case "/metrics/":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"mem": 1}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path string
+		opts Options
+		up   float64
+	}{
+		{"/metrics", Options{}, 1},
+		{"/metrics", Options{NoRedirects: true}, 0},
+		{"/twice", Options{MaxRedirects: 2}, 1},
+		{"/twice", Options{MaxRedirects: 1}, 0},
+	} {
+		tc.opts.Timeout = time.Second
+		e := NewExporter(ts.URL+tc.path, tc.opts)
+		if v, _ := findMetric(gather(t, e), "spring_actuator_up", nil); v != tc.up {
+			t.Errorf("%s with no redirects %v, max %d: up = %v, want %v (%s)", tc.path, tc.opts.NoRedirects, tc.opts.MaxRedirects, v, tc.up, e.Status().Error)
+		}
+	}
+}
+
+// A bad value only costs its own key: the other keys are exported, the
+// target stays up and the bad key counts as a parse error.
+func TestBadValues(t *testing.T) {
+	ts := fixtureServer(t, "testdata/boot1_grab_bag.json")
+	e := NewExporter(ts.URL+"/metrics", Options{Timeout: time.Second})
+	mfs := gather(t, e)
+	if v, _ := findMetric(mfs, "spring_actuator_up", nil); v != 1 {
+		t.Fatalf("up = %v, want 1: %s", v, e.Status().Error)
+	}
+	for _, tc := range []struct {
+		key    string
+		metric string
+		value  float64
+		ok     bool
+	}{
+		{"mem", "spring_actuator_mem", 1.2e6, true},
+		{"mem.free", "spring_actuator_mem_free", 42, true},
+		{"heap.used", "spring_actuator_heap_used", 750, true},
+		{"classes.loaded", "spring_actuator_classes_loaded", 12000, true},
+		{"classes.unloaded", "spring_actuator_classes_unloaded", 0, true},
+		{"heap.committed", "spring_actuator_heap_committed", 0, false},
+		{"nonheap.used", "spring_actuator_nonheap_used", 0, false},
+		{"nonheap.committed", "spring_actuator_nonheap_committed", 0, false},
+		{"threads", "spring_actuator_threads", 0, false},
+		{"classes", "spring_actuator_classes", 0, false},
+		{"systemload.average", "spring_actuator_systemload_average", 0, false},
+	} {
+		v, ok := findMetric(mfs, tc.metric, nil)
+		if ok != tc.ok || v != tc.value {
+			t.Errorf("%s: %s = %v (found %v), want %v (found %v)", tc.key, tc.metric, v, ok, tc.value, tc.ok)
+		}
+	}
+	if n := testutil.ToFloat64(e.parseErrors); n != 6 {
+		t.Errorf("%v parse errors counted, want 6", n)
+	}
+}
+
+// Partial failures leave a target up in lenient mode and take it down in
+// strict mode; a clean scrape is up in both.
+func TestUpMode(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		fixture string
+		fail    string
+		lenient float64
+		strict  float64
+	}{
+		{"clean", "testdata/gc_overhead.json", "", 1, 1},
+		{"bad values", "testdata/boot1_grab_bag.json", "", 1, 0},
+		{"failed meter", "testdata/gc_overhead.json", "/actuator/metrics/process.uptime", 1, 0},
+		{"failed index", "testdata/gc_overhead.json", "/actuator/metrics", 0, 0},
+	} {
+		responses := loadFixture(t, tc.fixture)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == tc.fail {
+				http.Error(w, "boom", http.StatusInternalServerError)
+				return
+			}
+			serveFixture(w, r, responses)
+		}))
+		path := "/actuator/metrics"
+		if strings.Contains(tc.fixture, "boot1") {
+			path = "/metrics"
+		}
+		for _, strict := range []bool{false, true} {
+			want := tc.lenient
+			if strict {
+				want = tc.strict
+			}
+			e := NewExporter(ts.URL+path, Options{Timeout: time.Second, StrictUp: strict})
+			if v, _ := findMetric(gather(t, e), "spring_actuator_up", nil); v != want {
+				t.Errorf("%s, strict %v: up = %v, want %v", tc.name, strict, v, want)
+			}
+		}
+		ts.Close()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"runtime"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// dumpTarget is the state of a target in a state dump.
+type dumpTarget struct {
+	targetEntry
+	ScrapeErrors map[string]float64 `json:"scrape_errors"`
+}
+
+type stateDump struct {
+	Time       time.Time    `json:"time"`
+	Goroutines int          `json:"goroutines"`
+	Targets    []dumpTarget `json:"targets"`
+}
+
+// scrapeErrorCounts returns the value of scrape_errors_total for each
+// reason.
+func (e *Exporter) scrapeErrorCounts() map[string]float64 {
+	counts := make(map[string]float64, len(scrapeErrorReasons))
+	for _, m := range gatherMetrics(e.scrapeErrors.Collect) {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "reason" {
+				counts[l.GetValue()] = pb.GetCounter().GetValue()
+			}
+		}
+	}
+	return counts
+}
+
+// dumpState writes the state of every target to w as JSON.
+func dumpState(w io.Writer, c *targetsCollector) {
+	st := stateDump{Time: time.Now(), Goroutines: runtime.NumGoroutine()}
+	for _, l := range c.sets {
+		ts := l.Load()
+		if ts == nil {
+			continue
+		}
+		for _, e := range ts.exporters {
+			st.Targets = append(st.Targets, dumpTarget{newTargetEntry(ts.source, e), e.scrapeErrorCounts()})
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(st); err != nil {
+		slog.Error("Can't dump state", "err", err)
+	}
+}
+
+// dumpStateOnSignal dumps the state of the targets whenever the process
+// receives one of dumpSignals, until ctx is cancelled.
+func dumpStateOnSignal(ctx context.Context, c *targetsCollector) {
+	if len(dumpSignals) == 0 {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, dumpSignals...)
+	defer signal.Stop(sig)
+	dumpStateOn(ctx, sig, os.Stderr, c)
+}
+
+// dumpStateOn dumps the state of the targets to w whenever a signal is
+// received on sig, until ctx is cancelled.
+func dumpStateOn(ctx context.Context, sig <-chan os.Signal, w io.Writer, c *targetsCollector) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			dumpState(w, c)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals make the exporter dump its state to stderr. SIGINFO is what
+// Ctrl-T sends on the BSDs.
+var dumpSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGINFO}
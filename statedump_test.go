@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpStateOnSignal(t *testing.T) {
+	up, down := memServer(t), closedAddr(t)
+	ts, err := newTargetSet([]string{up.URL + "/metrics", "http://" + down + "/metrics"}, Options{Timeout: time.Second}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets liveTargets
+	targets.Store(ts)
+	c := &targetsCollector{sets: []*liveTargets{&targets}}
+	gather(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal)
+	out := &syncBuffer{}
+	go dumpStateOn(ctx, sig, out, c)
+	sig <- os.Interrupt
+	// The dump is done once the next signal is taken.
+	sig <- os.Interrupt
+
+	var st stateDump
+	if err := json.NewDecoder(strings.NewReader(out.String())).Decode(&st); err != nil {
+		t.Fatalf("state dump isn't JSON: %v\n%s", err, out)
+	}
+	if st.Goroutines == 0 {
+		t.Error("no goroutine count in the state dump")
+	}
+	if len(st.Targets) != 2 {
+		t.Fatalf("%d targets in the state dump, want 2", len(st.Targets))
+	}
+	for _, target := range st.Targets {
+		wantUp := strings.HasPrefix(target.URL, up.URL)
+		if target.Up != wantUp || target.Time.IsZero() {
+			t.Errorf("%s: up %v, last scrape %v; want up %v after a scrape", target.URL, target.Up, target.Time, wantUp)
+		}
+		if !wantUp && target.ScrapeErrors["connect"] != 1 {
+			t.Errorf("%s: scrape errors %v, want 1 connect error", target.URL, target.ScrapeErrors)
+		}
+	}
+}
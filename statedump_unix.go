@@ -0,0 +1,12 @@
+//go:build !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !windows,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals make the exporter dump its state to stderr.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
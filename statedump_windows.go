@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// dumpSignals is empty: Windows has no signal to ask for a state dump.
+var dumpSignals []os.Signal
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// scrapeStatus is the outcome of the most recent scrape of a target.
+type scrapeStatus struct {
+	URL             string    `json:"url"`
+	Up              bool      `json:"up"`
+	Time            time.Time `json:"last_scrape"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+	ScrapeID        string    `json:"scrape_id,omitempty"`
+}
+
+func (e *Exporter) recordScrape(start time.Time, id string, err error) {
+	st := scrapeStatus{
+		URL:             e.URL,
+		ScrapeID:        id,
+		Up:              err == nil,
+		Time:            start,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		st.Error = redactError(err)
+	}
+	e.statusMu.Lock()
+	e.lastScrape = st
+	e.statusMu.Unlock()
+}
+
+// Status returns the outcome of the last scrape; its Time is zero if the
+// target hasn't been scraped yet. A password in the URL is redacted.
+func (e *Exporter) Status() scrapeStatus {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	st := e.lastScrape
+	st.URL = redactURL(e.URL)
+	return st
+}
+
+// seriesCounter remembers how many series the last gathering through it
+// produced, so the count can be reported without triggering another scrape.
+type seriesCounter struct {
+	series int64
+}
+
+// wrap returns a Gatherer that counts the series gathered by g.
+func (c *seriesCounter) wrap(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		var n int
+		for _, mf := range mfs {
+			n += len(mf.GetMetric())
+		}
+		atomic.StoreInt64(&c.series, int64(n))
+		return mfs, err
+	})
+}
+
+func (c *seriesCounter) Series() int64 {
+	return atomic.LoadInt64(&c.series)
+}
+
+type healthStatus struct {
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Targets       []scrapeStatus `json:"targets"`
+	ActiveSeries  int64          `json:"active_series"`
+}
+
+// healthHandler answers liveness probes with a plain "OK". Clients asking
+// for application/json get the exporter's current state instead.
+func healthHandler(start time.Time, targets func() []scrapeStatus, series *seriesCounter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsJSON(r) {
+			w.Write([]byte("OK"))
+			return
+		}
+		st := healthStatus{
+			UptimeSeconds: time.Since(start).Seconds(),
+			Targets:       targets(),
+			ActiveSeries:  series.Series(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	}
+}
+
+// startupChecked reports whether the actuator has been scraped successfully
+// at least once. Until it has, each call tries a scrape, so the check
+// doesn't depend on Prometheus scraping the exporter.
+func (e *Exporter) startupChecked() bool {
+	if atomic.LoadInt32(&e.hasSucceededOnce) == 1 {
+		return true
+	}
+	e.collectMu.Lock()
+	defer e.collectMu.Unlock()
+	if atomic.LoadInt32(&e.hasSucceededOnce) == 0 {
+		e.scrape(context.Background())
+	}
+	return atomic.LoadInt32(&e.hasSucceededOnce) == 1
+}
+
+// startupHandler serves a Kubernetes startup probe: 503 until every target
+// has been scraped successfully once, then 200 for good, whatever happens
+// to the targets afterwards.
+func startupHandler(exporters func() []*Exporter) http.HandlerFunc {
+	var started int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&started) == 0 {
+			for _, e := range exporters() {
+				if !e.startupChecked() {
+					http.Error(w, fmt.Sprintf("%s has not been scraped successfully yet", redactURL(e.URL)), http.StatusServiceUnavailable)
+					return
+				}
+			}
+			atomic.StoreInt32(&started, 1)
+		}
+		w.Write([]byte("OK"))
+	}
+}
+
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && t == "application/json" {
+			return true
+		}
+	}
+	return false
+}
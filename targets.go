@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// uriList is a flag that can be repeated and takes comma-separated values.
+// The first value given replaces the default.
+type uriList struct {
+	uris []string
+	set  bool
+}
+
+func (l *uriList) String() string {
+	return strings.Join(l.uris, ",")
+}
+
+func (l *uriList) Set(s string) error {
+	if !l.set {
+		l.uris, l.set = nil, true
+	}
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			l.uris = append(l.uris, u)
+		}
+	}
+	return nil
+}
+
+// targetLabel is the value of the target label for the actuator at rawurl:
+// its host:port.
+func targetLabel(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return rawurl
+	}
+	return u.Host
+}
+
+// targetSet groups the exporters of several targets. Every series carries
+// a target label, and targets are scraped concurrently, at most
+// maxConcurrent at a time.
+type targetSet struct {
+	exporters     []*Exporter
+	maxConcurrent int
+	// configs holds the targets file entry of each exporter, if any.
+	configs []*targetConfig
+	// labelNames are the constant label names shared by the exporters.
+	labelNames []string
+	// overrides are the metric overrides of the targets file, if any.
+	overrides []*metricOverride
+	// source tells where the targets come from: the command line, the
+	// targets file or a discovery mechanism.
+	source string
+}
+
+func newTargetSet(uris []string, opts Options, maxConcurrent int) (*targetSet, error) {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	opts.LabelNames = mergeLabelNames(opts.LabelNames, "target")
+	ts := &targetSet{maxConcurrent: maxConcurrent, labelNames: opts.LabelNames, source: "static"}
+	seen := make(map[string]string, len(uris))
+	for _, u := range uris {
+		o := opts
+		label := targetLabel(u)
+		if prev, ok := seen[label]; ok {
+			return nil, fmt.Errorf("%s and %s would both be labeled target=%q", redactURL(prev), redactURL(u), label)
+		}
+		seen[label] = u
+		knownSecrets.addURL(u)
+		o.ConstLabels = prometheus.Labels{"target": label}
+		for k, v := range opts.ConstLabels {
+			o.ConstLabels[k] = v
+		}
+		ts.exporters = append(ts.exporters, NewExporter(u, o))
+	}
+	return ts, nil
+}
+
+// mergeLabelNames returns the sorted union of names and more.
+func mergeLabelNames(names []string, more ...string) []string {
+	seen := make(map[string]bool, len(names)+len(more))
+	var merged []string
+	for _, n := range append(append([]string{}, names...), more...) {
+		if !seen[n] {
+			seen[n] = true
+			merged = append(merged, n)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// newConfiguredTargetSet builds one exporter per entry of a targets file.
+// Every target is labeled with its name and its extra labels. Exporters of
+// prev whose entry is unchanged are reused, so they keep their state.
+func newConfiguredTargetSet(cfg *targetsConfig, opts Options, maxConcurrent int, prev *targetSet) (*targetSet, error) {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	opts.LabelNames = cfg.labelNames(opts.LabelNames)
+	opts.MetricOverrides = cfg.MetricOverrides
+	reusable := make(map[string]int)
+	if prev != nil && reflect.DeepEqual(prev.labelNames, opts.LabelNames) && reflect.DeepEqual(prev.overrides, opts.MetricOverrides) {
+		for i, t := range prev.configs {
+			if t != nil {
+				reusable[t.Name] = i
+			}
+		}
+	}
+	ts := &targetSet{maxConcurrent: maxConcurrent, labelNames: opts.LabelNames, overrides: opts.MetricOverrides, source: "file"}
+	for _, t := range cfg.Targets {
+		if i, ok := reusable[t.Name]; ok && reflect.DeepEqual(prev.configs[i], t) {
+			ts.exporters = append(ts.exporters, prev.exporters[i])
+			ts.configs = append(ts.configs, t)
+			continue
+		}
+		o, err := t.options(opts)
+		if err != nil {
+			return nil, err
+		}
+		knownSecrets.addURL(t.URL)
+		ts.exporters = append(ts.exporters, NewExporter(t.URL, o))
+		ts.configs = append(ts.configs, t)
+	}
+	return ts, nil
+}
+
+// collectUntil scrapes the targets concurrently, at most maxConcurrent at a
+// time, and sends the metrics of each as soon as it is done. Targets not
+// done by deadline, if it isn't zero, are reported down instead; their
+// scrapes run on, unless ctx is done, but their results are dropped.
+func (ts *targetSet) collectUntil(ctx context.Context, ch chan<- prometheus.Metric, deadline time.Time) {
+	type result struct {
+		e       *Exporter
+		metrics []prometheus.Metric
+	}
+	results := make(chan result, len(ts.exporters))
+	abort := make(chan struct{})
+	defer close(abort)
+	go func() {
+		sem := make(chan struct{}, ts.maxConcurrent)
+		for _, e := range ts.exporters {
+			select {
+			case sem <- struct{}{}:
+			case <-abort:
+				return
+			}
+			go func(e *Exporter) {
+				defer func() { <-sem }()
+				results <- result{e, gatherMetrics(func(ch chan<- prometheus.Metric) {
+					e.collectContext(ctx, ch, false)
+				})}
+			}(e)
+		}
+	}()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	done := make(map[*Exporter]bool, len(ts.exporters))
+	for len(done) < len(ts.exporters) {
+		select {
+		case r := <-results:
+			done[r.e] = true
+			for _, m := range r.metrics {
+				ch <- m
+			}
+		case <-expired:
+			for _, e := range ts.exporters {
+				if !done[e] {
+					e.deadlineExceeded(ch)
+				}
+			}
+			return
+		}
+	}
+}
+
+// gatherMetrics runs collect and returns what it sent.
+func gatherMetrics(collect func(chan<- prometheus.Metric)) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	collect(ch)
+	close(ch)
+	<-done
+	return metrics
+}
+
+// Statuses returns the last scrape outcome of every target.
+func (ts *targetSet) Statuses() []scrapeStatus {
+	statuses := make([]scrapeStatus, 0, len(ts.exporters))
+	for _, e := range ts.exporters {
+		statuses = append(statuses, e.Status())
+	}
+	return statuses
+}
+
+// liveTargets holds a target set that can be swapped at any time: a
+// collection already running finishes with the set it started with, and
+// the series of removed targets disappear from the next one.
+type liveTargets struct {
+	current atomic.Value
+}
+
+func (l *liveTargets) Load() *targetSet {
+	ts, _ := l.current.Load().(*targetSet)
+	return ts
+}
+
+// Store makes ts the current set. Exporters that scrape in the background
+// are started if they are new; exporters that are gone are closed.
+func (l *liveTargets) Store(ts *targetSet) {
+	kept := make(map[*Exporter]bool, len(ts.exporters))
+	for _, e := range ts.exporters {
+		kept[e] = true
+		e.startBackground()
+	}
+	if old, ok := l.current.Swap(ts).(*targetSet); ok {
+		for _, e := range old.exporters {
+			if !kept[e] {
+				e.Close()
+			}
+		}
+	}
+}
+
+// Statuses returns the last scrape outcome of every current target.
+func (l *liveTargets) Statuses() []scrapeStatus {
+	if ts := l.Load(); ts != nil {
+		return ts.Statuses()
+	}
+	return nil
+}
+
+// targetsCollector collects the static and discovered targets. With a
+// timeout, targets that haven't been scraped in time are reported down so
+// that a slow target can't make the whole scrape fail. Scrapes are
+// abandoned once ctx, if set, is done. It is an unchecked collector since
+// the metrics it yields change with the targets.
+type targetsCollector struct {
+	sets    []*liveTargets
+	ctx     context.Context
+	timeout time.Duration
+}
+
+// within returns a collector of the same targets for a caller that gives
+// up once ctx is done, with the given timeout.
+func (c *targetsCollector) within(ctx context.Context, timeout time.Duration) *targetsCollector {
+	return &targetsCollector{sets: c.sets, ctx: ctx, timeout: timeout}
+}
+
+func (c *targetsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *targetsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	var wg sync.WaitGroup
+	for _, l := range c.sets {
+		ts := l.Load()
+		if ts == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.collectUntil(ctx, ch, deadline)
+		}()
+	}
+	wg.Wait()
+}
+
+// stopBackground stops the background scrapes of every current target.
+func (c *targetsCollector) stopBackground() {
+	for _, l := range c.sets {
+		if ts := l.Load(); ts != nil {
+			for _, e := range ts.exporters {
+				e.stopBackground()
+			}
+		}
+	}
+}
+
+// closeIdleConnections closes the idle connections of the clients of every
+// current target.
+func (c *targetsCollector) closeIdleConnections() {
+	for _, l := range c.sets {
+		if ts := l.Load(); ts != nil {
+			for _, e := range ts.exporters {
+				e.client.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+// Statuses returns the last scrape outcome of every current target.
+func (c *targetsCollector) Statuses() []scrapeStatus {
+	var statuses []scrapeStatus
+	for _, l := range c.sets {
+		statuses = append(statuses, l.Statuses()...)
+	}
+	return statuses
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func memServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mem": 1}`))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// hasTarget tells whether any series is labeled target=label.
+func hasTarget(mfs []*dto.MetricFamily, label string) bool {
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "target" && l.GetValue() == label {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// The series of a removed target go away with it.
+func TestRemovedTargetSeriesGone(t *testing.T) {
+	a, b := memServer(t), memServer(t)
+	opts := Options{Timeout: time.Second}
+	var targets liveTargets
+	c := &targetsCollector{sets: []*liveTargets{&targets}}
+
+	ts, err := newTargetSet([]string{a.URL + "/metrics", b.URL + "/metrics"}, opts, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets.Store(ts)
+	mfs := gather(t, c)
+	gone := targetLabel(b.URL + "/metrics")
+	if !hasTarget(mfs, gone) {
+		t.Fatalf("no series for target %s before it is removed", gone)
+	}
+
+	ts, err = newTargetSet([]string{a.URL + "/metrics"}, opts, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets.Store(ts)
+	mfs = gather(t, c)
+	if hasTarget(mfs, gone) {
+		t.Errorf("series of removed target %s still exported", gone)
+	}
+	if !hasTarget(mfs, targetLabel(a.URL+"/metrics")) {
+		t.Error("series of the remaining target lost")
+	}
+}
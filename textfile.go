@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+const textfileName = "spring_actuator.prom"
+
+// writeTextfile gathers g and writes it in the text exposition format to
+// path. The file is written next to its destination and renamed into place
+// so the node_exporter textfile collector never reads a partial file.
+func writeTextfile(g prometheus.Gatherer, path string) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(tmp, mf); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// runTextfileWriter rewrites the textfile in dir every interval until ctx is
+// cancelled.
+func runTextfileWriter(ctx context.Context, g prometheus.Gatherer, dir string, interval time.Duration) {
+	path := filepath.Join(dir, textfileName)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := writeTextfile(g, path); err != nil {
+			slog.Error("Can't write textfile", "file", path, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+type traceIDKey struct{}
+
+// randomHex returns n random bytes, hex-encoded. All zero IDs are invalid
+// in W3C trace context, which crypto/rand makes vanishingly unlikely.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		slog.Error("Can't generate trace context", "err", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// withTrace starts a trace for a scrape of url. Every request of the scrape
+// is a span of it.
+func withTrace(ctx context.Context, url string) context.Context {
+	id := randomHex(16)
+	slog.DebugContext(ctx, "Scraping in trace", "target", redactURL(url), "trace_id", id)
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// injectTrace adds a W3C traceparent header to req, with a new span ID, if
+// its context carries a trace.
+func injectTrace(req *http.Request) {
+	id, ok := req.Context().Value(traceIDKey{}).(string)
+	if !ok {
+		return
+	}
+	span := randomHex(8)
+	slog.DebugContext(req.Context(), "Fetching in trace", "url", redactURL(req.URL.String()), "trace_id", id, "span_id", span)
+	req.Header.Set("traceparent", "00-"+id+"-"+span+"-01")
+}
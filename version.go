@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// versionRefreshInterval bounds how often the info endpoint is queried for
+// the Spring versions.
+const versionRefreshInterval = time.Hour
+
+const unknownVersion = "unknown"
+
+type springVersion struct {
+	boot, framework string
+}
+
+func newVersionMetric(constLabels prometheus.Labels) *prometheus.GaugeVec {
+	return newMetrics("spring_version_info", "Spring Boot and Spring Framework versions of the application", constLabels, []string{"spring_boot_version", "spring_framework_version"})
+}
+
+// lookupInfo finds key in an info document, either as a flat dotted key
+// or as nested objects.
+func lookupInfo(info map[string]interface{}, key string) string {
+	if v, ok := info[key].(string); ok {
+		return v
+	}
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) == 2 {
+		if nested, ok := info[parts[0]].(map[string]interface{}); ok {
+			return lookupInfo(nested, parts[1])
+		}
+	}
+	return ""
+}
+
+// detectVersion works out the Spring versions from the info endpoint. When
+// the application doesn't publish them it falls back to the major Boot
+// version: 1.x sends an X-Application-Context header, 2.x serves a
+// hypermedia index at the actuator root.
+func (e *Exporter) detectVersion() springVersion {
+	v := springVersion{boot: unknownVersion, framework: unknownVersion}
+	e.refreshLinks()
+	var info map[string]interface{}
+	if err := e.fetchJSON(e.endpointURL("info"), &info); err == nil {
+		if b := lookupInfo(info, "spring-boot.version"); b != "" {
+			v.boot = b
+		}
+		for _, key := range []string{"spring-framework.version", "spring.version"} {
+			if f := lookupInfo(info, key); f != "" {
+				v.framework = f
+				break
+			}
+		}
+	} else {
+		slog.DebugContext(e.logContext(), "Can't fetch info endpoint", "target", redactURL(e.URL), "err", redactError(err))
+	}
+	if v.boot != unknownVersion {
+		return v
+	}
+	if atomic.LoadInt32(&e.appContextSeen) == 1 {
+		v.boot = "1.x"
+		return v
+	}
+	if len(e.links) > 0 {
+		v.boot = "2.x"
+		return v
+	}
+	var index actuatorIndex
+	if err := e.fetchJSON(e.endpointURL(""), &index); err == nil && len(index.Links) > 0 {
+		v.boot = "2.x"
+	}
+	return v
+}
+
+// Version returns the Spring versions, detecting them again if they are
+// stale. Unlike refreshVersion it may be called while the exporter is
+// being scraped.
+func (e *Exporter) Version() springVersion {
+	e.collectMu.Lock()
+	defer e.collectMu.Unlock()
+	return e.refreshVersion()
+}
+
+// refreshVersion re-detects the Spring versions if the cached ones are
+// older than versionRefreshInterval and returns the current value.
+func (e *Exporter) refreshVersion() springVersion {
+	if !e.versionCheckedAt.IsZero() && time.Since(e.versionCheckedAt) < versionRefreshInterval {
+		return e.version
+	}
+	e.version = e.detectVersion()
+	e.versionCheckedAt = time.Now()
+	return e.version
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// newTLSConfig builds the server TLS configuration around the certificate
+// served by certs. Client certificates are verified against the CA bundle
+// in clientCAFile when clientAuth asks for it.
+func newTLSConfig(certs *certReloader, clientCAFile, clientAuth string) (*tls.Config, error) {
+	authType, ok := clientAuthTypes[clientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth type %q", clientAuth)
+	}
+	cfg := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		ClientAuth:     authType,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+	} else if authType == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client auth %q needs a client CA file", clientAuth)
+	}
+	return cfg, nil
+}
+
+// serverErrorWriter routes net/http's internal error log to our logger.
+// TLS handshake failures, typically port scanners or scrapers without a
+// valid client certificate, are only logged at debug level.
+type serverErrorWriter struct{}
+
+func (serverErrorWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimSpace(p))
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		slog.Debug("HTTP server error", "err", msg)
+	} else {
+		slog.Error("HTTP server error", "err", msg)
+	}
+	return len(p), nil
+}
+
+func newServerErrorLog() *stdlog.Logger {
+	return stdlog.New(serverErrorWriter{}, "", 0)
+}
+
+// configureH2C lets the server speak cleartext HTTP/2 alongside HTTP/1.1. The
+// http2.Server is hooked into server's shutdown so open streams are sent a
+// GOAWAY and allowed to finish.
+func configureH2C(server *http.Server) error {
+	h2s := &http2.Server{}
+	// ConfigureServer sets up TLSConfig for h2 over TLS, which would make
+	// the server serve TLS only.
+	tlsConfig := server.TLSConfig
+	if err := http2.ConfigureServer(server, h2s); err != nil {
+		return err
+	}
+	server.TLSConfig = tlsConfig
+	handler := server.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server.Handler = h2c.NewHandler(handler, h2s)
+	return nil
+}
+
+// shutdownContext returns a context that is cancelled when the process
+// receives SIGINT or SIGTERM.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// serve runs server, over TLS if server.TLSConfig is set, until it fails or
+// ctx is cancelled, in which case in-flight requests get up to
+// shutdownTimeout to complete.
+func serve(ctx context.Context, server *http.Server, shutdownTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errc <- server.ListenAndServeTLS("", "")
+		} else {
+			errc <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("Shutting down server")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// serveAll runs servers concurrently. When one of them fails the others are
+// shut down too, and the first error is returned.
+func serveAll(ctx context.Context, servers []*http.Server, shutdownTimeout time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			err := serve(ctx, srv, shutdownTimeout)
+			if err != nil && err != http.ErrServerClosed {
+				once.Do(func() { firstErr = err })
+			}
+			cancel()
+		}(srv)
+	}
+	wg.Wait()
+	return firstErr
+}